@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"gophermart/internal/app"
+	"gophermart/internal/models"
+	"gophermart/internal/validation"
+)
+
+// runCommand executes an administrative command given as positional arguments,
+// e.g. `gophermart unlock alice` or `gophermart grant-admin alice`. It reports
+// false when no command was given.
+func runCommand(ctx context.Context, application *app.App) (bool, error) {
+	args := flag.Args()
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "unlock":
+		if len(args) != 2 {
+			return true, fmt.Errorf("usage: unlock <login|ip>")
+		}
+		if err := application.Guard.Unlock(ctx, args[1]); err != nil {
+			return true, err
+		}
+		fmt.Printf("Unlocked %s\n", args[1])
+		return true, nil
+	case "grant-admin":
+		if len(args) != 2 {
+			return true, fmt.Errorf("usage: grant-admin <login>")
+		}
+		user, err := application.Storage.GetUserByLogin(ctx, validation.NormalizeLogin(args[1]))
+		if err != nil {
+			return true, fmt.Errorf("find user %s: %w", args[1], err)
+		}
+		if err := application.Storage.AddUserRole(ctx, user.ID, models.RoleAdmin); err != nil {
+			return true, err
+		}
+		fmt.Printf("Granted %s role to %s\n", models.RoleAdmin, user.Login)
+		return true, nil
+	default:
+		return true, fmt.Errorf("unknown command %q", args[0])
+	}
+}
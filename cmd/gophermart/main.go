@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
@@ -19,7 +20,12 @@ import (
 func main() {
 	cfg := config.Load()
 
-	middleware.InitJWT(cfg.JWTSecret)
+	if err := middleware.InitJWT(cfg); err != nil {
+		log.Fatalf("Failed to initialize JWT keys: %v", err)
+	}
+	if cfg.TOTPKey == "" {
+		log.Print("Two-factor enrollment is disabled; set -totp-key or a JWT secret other than the default")
+	}
 
 	db, err := sql.Open("pgx", cfg.DatabaseURI)
 	if err != nil {
@@ -51,6 +57,13 @@ func main() {
 	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 
+	if ok, err := runCommand(ctx, application); ok {
+		if err != nil {
+			log.Fatalf("Command failed: %v", err)
+		}
+		return
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	for range cfg.NumWorkers {
@@ -59,6 +72,34 @@ func main() {
 		})
 	}
 
+	g.Go(func() error {
+		return application.Events.Run(ctx, cfg.EventsRetention)
+	})
+
+	g.Go(func() error {
+		return application.Webhooks.Run(ctx)
+	})
+
+	if cfg.GRPCAddress != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", cfg.GRPCAddress, err)
+		}
+		if cfg.GRPCTLSCert == "" {
+			log.Printf("gRPC server on %s runs without TLS; set -grpc-tls-cert and -grpc-tls-key unless a proxy terminates TLS", cfg.GRPCAddress)
+		}
+		grpcServer := application.GRPC.GRPCServer()
+		g.Go(func() error {
+			log.Printf("Starting gRPC server on %s\n", cfg.GRPCAddress)
+			return grpcServer.Serve(lis)
+		})
+		g.Go(func() error {
+			<-ctx.Done()
+			grpcServer.GracefulStop()
+			return nil
+		})
+	}
+
 	g.Go(func() error {
 		log.Printf("Starting server on %s\n", cfg.RunAddress)
 		return http.ListenAndServe(cfg.RunAddress, application.Router)
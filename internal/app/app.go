@@ -5,25 +5,48 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
 	"gophermart/internal/config"
+	"gophermart/internal/grpcapi"
 	"gophermart/internal/handlers"
 	md "gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/openapi"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
 	"gophermart/internal/services"
 	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+	"gophermart/internal/validation"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"google.golang.org/grpc/credentials"
 )
 
 type App struct {
-	DB      *sql.DB
-	Router  *chi.Mux
-	Config  config.Config
-	Storage storage.Storage
-	Accrual *services.AccrualService
+	DB        *sql.DB
+	Router    *chi.Mux
+	Config    config.Config
+	Storage   storage.Storage
+	Accrual   *services.AccrualService
+	Notifier  services.Notifier
+	Guard     *services.LoginGuard
+	TwoFactor *services.TwoFactorService
+	Policy    *validation.Policy
+	OIDC      *services.OIDCProvider
+	Events    *services.EventBroker
+	Webhooks  *services.WebhookDispatcher
+	Auth      *services.AuthService
+	Orders    *services.OrderService
+	Balance   *services.BalanceService
+	GRPC      *grpcapi.Server
+	Limiter   *md.RateLimiter
 }
 
 func NewApp(cfg config.Config, storage storage.Storage, accrual *services.AccrualService) (*App, error) {
@@ -50,35 +73,275 @@ func NewApp(cfg config.Config, storage storage.Storage, accrual *services.Accrua
 		Accrual: accrual,
 	}
 
-	app.initRouter()
+	if cfg.NotifyFile != "" {
+		app.Notifier = services.NewFileNotifier(cfg.NotifyFile)
+	} else {
+		app.Notifier = services.NewOutboxNotifier(storage)
+	}
+
+	app.Guard = services.NewLoginGuard(
+		storage,
+		cfg.LoginMaxAttempts,
+		cfg.LoginIPMaxAttempts,
+		cfg.LoginLockout,
+		cfg.LoginMaxLockout,
+	)
+
+	var totpKey []byte
+	if cfg.TOTPKey != "" {
+		totpKey = utils.SecretKey(cfg.TOTPKey)
+	}
+	app.TwoFactor = services.NewTwoFactorService(storage, app.Guard, cfg.TOTPIssuer, totpKey)
+	if err := app.TwoFactor.EncryptSecrets(ctx); err != nil {
+		return nil, fmt.Errorf("encrypt TOTP secrets: %w", err)
+	}
+	app.Events = services.NewEventBroker(storage, db)
+	app.Webhooks = services.NewWebhookDispatcher(storage, cfg.WebhookAllowPrivate)
+
+	app.Policy, err = validation.NewPolicy(
+		cfg.LoginPattern,
+		cfg.PasswordMinLength,
+		cfg.PasswordMinClasses,
+		cfg.PasswordBlocklist,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.OIDCIssuer != "" {
+		app.OIDC = services.NewOIDCProvider(
+			&http.Client{Timeout: 10 * time.Second},
+			cfg.OIDCIssuer,
+			cfg.OIDCClientID,
+			cfg.OIDCClientSecret,
+			cfg.OIDCRedirectURL,
+		)
+	}
+
+	app.Auth = services.NewAuthService(storage, app.Guard, app.TwoFactor)
+	app.Orders = services.NewOrderService(storage)
+	app.Balance = services.NewBalanceService(
+		storage,
+		app.TwoFactor,
+		app.Events,
+		app.Webhooks,
+		cfg.TOTPWithdrawalSum,
+		models.TransferLimits{
+			DailySum:   cfg.TransferDailySum,
+			DailyCount: cfg.TransferDailyCount,
+		},
+	)
+
+	if err := md.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	limits, err := md.ParseRateLimits(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.RateLimitStore {
+	case "memory":
+		app.Limiter = md.NewRateLimiter(md.NewMemoryRateLimitStore(), limits)
+	case "postgres":
+		app.Limiter = md.NewRateLimiter(md.NewStorageRateLimitStore(storage), limits)
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.RateLimitStore)
+	}
+
+	var creds credentials.TransportCredentials
+	if cfg.GRPCTLSCert != "" || cfg.GRPCTLSKey != "" {
+		if creds, err = credentials.NewServerTLSFromFile(cfg.GRPCTLSCert, cfg.GRPCTLSKey); err != nil {
+			return nil, fmt.Errorf("load gRPC TLS key pair: %w", err)
+		}
+	}
+	app.GRPC = grpcapi.NewServer(
+		storage,
+		app.Auth,
+		app.Orders,
+		app.Balance,
+		app.Policy,
+		app.Limiter,
+		creds,
+	)
+
+	doc, err := openapi.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := app.initRouter(doc); err != nil {
+		return nil, err
+	}
 	return app, nil
 }
 
-func (a *App) initRouter() {
+func (a *App) initRouter(doc *openapi3.T) error {
+	validator, err := openapi.Validator(doc)
+	if err != nil {
+		return err
+	}
+	specHandler, err := openapi.Handler(doc)
+	if err != nil {
+		return err
+	}
+
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(md.RequestIDHeader)
 	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+	r.Use(md.Recoverer)
+	if a.Limiter != nil {
+		r.Use(a.Limiter.Handler)
+	}
 	r.Use(middleware.Compress(5))
+	r.Use(md.RequestBody(int64(a.Config.MaxBodySize), int64(a.Config.MaxDecodedBodySize)))
+	r.NotFound(problem.NotFound)
+	r.MethodNotAllowed(problem.MethodNotAllowed)
+
+	authHandler := handlers.NewAuthHandler(a.Storage, a.Auth, a.Policy)
+	passwordHandler := handlers.NewPasswordHandler(a.Storage, a.Auth, a.Notifier, a.Policy, a.Config.PasswordResetTTL)
+	profileHandler := handlers.NewProfileHandler(a.Storage, a.Notifier, a.Config.EmailVerifyTTL)
 
-	authHandler := handlers.NewAuthHandler(a.Storage)
-	r.Post("/api/user/register", authHandler.Register)
-	r.Post("/api/user/login", authHandler.Login)
+	// Requests are validated against the spec only once they are
+	// authenticated, so that clients without access learn nothing but 401.
+	r.Group(func(r chi.Router) {
+		r.Use(validator)
+
+		r.Get("/api/openapi.json", specHandler)
+		r.Get("/api/docs", openapi.Docs)
+
+		r.Get("/.well-known/jwks.json", md.JWKS)
+
+		// The routes that predate /api/v2 answer as they always have, in
+		// JSON only.
+		r.With(render.JSONOnly).Post("/api/user/register", authHandler.Register)
+		r.With(render.JSONOnly).Post("/api/user/login", authHandler.Login)
+		r.Post("/api/user/login/2fa", authHandler.LoginTwoFactor)
+
+		if a.OIDC != nil {
+			oidcHandler := handlers.NewOIDCHandler(a.Storage, a.OIDC, a.Config.OIDCPostLoginURL)
+			r.With(md.Verifier()).Get("/api/user/oidc/login", oidcHandler.Login)
+			r.Get("/api/user/oidc/callback", oidcHandler.Callback)
+		}
+
+		r.Post("/api/user/password/reset", passwordHandler.RequestReset)
+		r.Post("/api/user/password/reset/confirm", passwordHandler.ConfirmReset)
+		r.Post("/api/user/email/verify/confirm", profileHandler.ConfirmEmailVerification)
+	})
+
+	orderHandler := handlers.NewOrderHandler(a.Storage, a.Orders)
+	balanceHandler := handlers.NewBalanceHandler(a.Storage, a.Balance)
+	twoFactorHandler := handlers.NewTwoFactorHandler(a.Storage, a.TwoFactor)
 
-	orderHandler := handlers.NewOrderHandler(a.Storage)
-	balanceHandler := handlers.NewBalanceHandler(a.Storage)
+	apiKeyHandler := handlers.NewAPIKeyHandler(a.Storage)
+	sessionHandler := handlers.NewSessionHandler(a.Storage)
+	accountHandler := handlers.NewAccountHandler(a.Storage, a.TwoFactor)
+	eventHandler := handlers.NewEventHandler(a.Storage, a.Events, a.Config.EventsHeartbeat)
+	webhookHandler := handlers.NewWebhookHandler(a.Storage)
+	exportHandler := handlers.NewExportHandler(a.Storage, a.Config.MaxXLSXExports)
+	csrf := md.CSRF(splitList(a.Config.CSRFTrustedOrigins), a.Config.CSRFRequireToken)
+	etag := md.ETag(a.Storage)
 
+	// Routes open to user tokens and to partner API keys holding the scope.
 	r.Group(func(r chi.Router) {
+		r.Use(md.APIKeyVerifier(a.Storage))
 		r.Use(md.Verifier())
-		r.Use(md.Authenticator())
+		r.Use(md.Authenticator(a.Storage))
+		r.Use(csrf)
+		r.Use(validator)
 
-		r.Post("/api/user/orders", orderHandler.UploadOrder)
-		r.Get("/api/user/orders", orderHandler.GetOrders)
-		r.Get("/api/user/balance", balanceHandler.GetBalance)
-		r.Post("/api/user/balance/withdraw", balanceHandler.Withdraw)
-		r.Get("/api/user/withdrawals", balanceHandler.GetWithdrawals)
+		r.With(render.JSONOnly, md.RequireScope(md.ScopeOrdersWrite)).Post("/api/user/orders", orderHandler.UploadOrder)
+		r.With(md.RequireScope(md.ScopeOrdersWrite)).Post("/api/user/orders/batch", orderHandler.UploadOrders)
+		r.With(render.JSONOnly, md.RequireScope(md.ScopeOrdersRead), etag).Get("/api/user/orders", orderHandler.GetOrders)
+		r.With(render.JSONOnly, md.RequireScope(md.ScopeBalanceRead), etag).Get("/api/user/balance", balanceHandler.GetBalance)
+		r.With(md.RequireScope(md.ScopeBalanceRead), etag).Get("/api/user/balance/history", balanceHandler.GetHistory)
+		r.With(render.JSONOnly, md.RequireScope(md.ScopeWithdrawalsRead), etag).Get("/api/user/withdrawals", balanceHandler.GetWithdrawals)
+		r.With(md.RequireScope(md.ScopeOrdersRead)).Get("/api/user/orders/export", exportHandler.ExportOrders)
+		r.With(md.RequireScope(md.ScopeWithdrawalsRead)).Get("/api/user/withdrawals/export", exportHandler.ExportWithdrawals)
+	})
+
+	// Routes open to user tokens only.
+	r.Group(func(r chi.Router) {
+		r.Use(md.Verifier())
+		r.Use(md.Authenticator(a.Storage))
+		r.Use(csrf)
+		r.Use(validator)
+
+		r.With(render.JSONOnly).Post("/api/user/balance/withdraw", balanceHandler.Withdraw)
+		r.Post("/api/user/balance/transfer", balanceHandler.Transfer)
+		r.Post("/api/user/password", passwordHandler.ChangePassword)
+		r.Post("/api/user/2fa/enroll", twoFactorHandler.Enroll)
+		r.Post("/api/user/2fa/verify", twoFactorHandler.Verify)
+		r.Post("/api/user/2fa/disable", twoFactorHandler.Disable)
+		r.Post("/api/user/api-keys", apiKeyHandler.CreateKey)
+		r.Get("/api/user/api-keys", apiKeyHandler.GetKeys)
+		r.Delete("/api/user/api-keys/{id}", apiKeyHandler.RevokeKey)
+		r.Get("/api/user/sessions", sessionHandler.GetSessions)
+		r.Delete("/api/user/sessions/{id}", sessionHandler.RevokeSession)
+		r.Get("/api/user/me", profileHandler.GetProfile)
+		r.Patch("/api/user/me", profileHandler.UpdateProfile)
+		r.Post("/api/user/me/email/verify", profileHandler.RequestEmailVerification)
+		r.Get("/api/user/export", accountHandler.Export)
+		r.Delete("/api/user", accountHandler.Delete)
+		r.Get("/api/user/events", eventHandler.Stream)
+		r.Get("/api/user/events/ws", eventHandler.WebSocket)
+		r.Post("/api/user/webhooks", webhookHandler.CreateWebhook)
+		r.Get("/api/user/webhooks", webhookHandler.GetWebhooks)
+		r.Delete("/api/user/webhooks/{id}", webhookHandler.DeleteWebhook)
+		r.Get("/api/user/webhooks/{id}/deliveries", webhookHandler.GetDeliveries)
+	})
+
+	v2Handler := handlers.NewV2Handler(a.Storage, orderHandler, balanceHandler)
+
+	r.Route("/api/v2", func(r chi.Router) {
+		r.Group(func(r chi.Router) {
+			r.Use(md.APIKeyVerifier(a.Storage))
+			r.Use(md.Verifier())
+			r.Use(md.Authenticator(a.Storage))
+			r.Use(csrf)
+			r.Use(validator)
+
+			r.With(md.RequireScope(md.ScopeOrdersWrite)).Post("/orders", v2Handler.UploadOrder)
+			r.With(md.RequireScope(md.ScopeOrdersRead), etag).Get("/orders", v2Handler.GetOrders)
+			r.With(md.RequireScope(md.ScopeBalanceRead), etag).Get("/balance", v2Handler.GetBalance)
+			r.With(md.RequireScope(md.ScopeWithdrawalsRead), etag).Get("/withdrawals", v2Handler.GetWithdrawals)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(md.Verifier())
+			r.Use(md.Authenticator(a.Storage))
+			r.Use(csrf)
+			r.Use(validator)
+
+			r.Post("/withdrawals", v2Handler.Withdraw)
+		})
+	})
+
+	adminHandler := handlers.NewAdminHandler(a.Storage, a.Guard)
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(md.Verifier())
+		r.Use(md.Authenticator(a.Storage))
+		r.Use(csrf)
+		r.Use(md.RequireRole(models.RoleAdmin))
+		r.Use(validator)
+
+		r.Get("/users/{login}", adminHandler.GetUser)
+		r.Put("/users/{login}/roles", adminHandler.SetRoles)
+		r.Delete("/login-locks/{key}", adminHandler.UnlockLogin)
 	})
 
 	a.Router = r
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
 
 func (a *App) ProcessOrdersWorker(ctx context.Context) error {
@@ -108,6 +371,13 @@ func (a *App) processOrdersBatch(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("set processing status: %w", err)
 	}
+	for number, userID := range userIDs {
+		a.Events.Publish(ctx, userID, services.EventOrderStatus, map[string]interface{}{
+			"number":  number,
+			"status":  "PROCESSING",
+			"accrual": 0,
+		})
+	}
 
 	for _, number := range orders {
 		accrual, err := a.Accrual.GetAccrual(ctx, number)
@@ -116,23 +386,34 @@ func (a *App) processOrdersBatch(ctx context.Context) error {
 			continue
 		}
 
-		if err := a.Storage.UpdateOrder(ctx, number, accrual.Status, accrual.Accrual); err != nil {
+		userID, changed, err := a.Storage.UpdateOrder(ctx, number, accrual.Status, accrual.Accrual)
+		if err != nil {
 			log.Printf("Failed to update order %s: %v", number, err)
 			continue
 		}
+		if changed {
+			a.Events.Publish(ctx, userID, services.EventOrderStatus, map[string]interface{}{
+				"number":  number,
+				"status":  accrual.Status,
+				"accrual": accrual.Accrual,
+			})
 
-		if accrual.Status == "PROCESSED" && accrual.Accrual > 0 {
-			userID := userIDs[number]
-			if _, err := a.DB.ExecContext(ctx,
-				`INSERT INTO balances (user_id, current, withdrawn) 
-				 VALUES ($1, $2, 0)
-				 ON CONFLICT (user_id) DO UPDATE 
-				 SET current = balances.current + EXCLUDED.current`,
-				userID, accrual.Accrual,
-			); err != nil {
-				log.Printf("Failed to update balance for user %d: %v", userID, err)
+			switch accrual.Status {
+			case "PROCESSED":
+				a.Webhooks.Enqueue(ctx, userID, services.WebhookOrderProcessed, map[string]interface{}{
+					"number":  number,
+					"accrual": accrual.Accrual,
+				})
+			case "INVALID":
+				a.Webhooks.Enqueue(ctx, userID, services.WebhookOrderInvalid, map[string]interface{}{
+					"number": number,
+				})
 			}
 		}
+
+		if changed && accrual.Status == "PROCESSED" && accrual.Accrual > 0 {
+			a.Events.PublishBalance(ctx, userID)
+		}
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"gophermart/internal/config"
+	md "gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/openapi"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	cfg := config.Config{JWTAlg: "HS256", JWTSecret: "secret", MaxBodySize: 1 << 20, MaxDecodedBodySize: 4 << 20}
+	if err := md.InitJWT(cfg); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The storage is not called while routes are set up.
+	var store storage.Storage
+	a := &App{Config: cfg, Storage: store}
+	if err := a.initRouter(doc); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestDefaultRateLimits(t *testing.T) {
+	limits, err := md.ParseRateLimits(config.DefaultRateLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		requests int
+	}{
+		{method: http.MethodPost, path: "/api/user/login/2fa", requests: 10},
+		{method: http.MethodPost, path: "/api/user/2fa/verify", requests: 10},
+		{method: http.MethodPost, path: "/api/user/password", requests: 10},
+		{method: http.MethodPost, path: "/api/user/me/email/verify", requests: 5},
+		{method: http.MethodPost, path: "/api/user/email/verify/confirm", requests: 10},
+		{method: http.MethodPost, path: "/api/user/orders/batch", requests: 10},
+		{method: http.MethodPost, path: "/api/v2/orders", requests: 60},
+		{method: http.MethodPost, path: "/api/user/balance/transfer", requests: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			a := newTestApp(t)
+			a.Limiter = md.NewRateLimiter(md.NewMemoryRateLimitStore(), limits)
+			if err := a.initRouter(mustLoadSpec(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 1; i <= tt.requests+1; i++ {
+				w := httptest.NewRecorder()
+				a.Router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{}`)))
+				if i <= tt.requests && w.Code == http.StatusTooManyRequests {
+					t.Fatalf("request %d rate limited", i)
+				}
+				if i > tt.requests && w.Code != http.StatusTooManyRequests {
+					t.Fatalf("request %d: status = %d, want 429", i, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func mustLoadSpec(t *testing.T) *openapi3.T {
+	t.Helper()
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestRoutesMatchSpec(t *testing.T) {
+	a := newTestApp(t)
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := openapi.CheckRoutes(doc, a.Router); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidationAfterAuthentication(t *testing.T) {
+	a := newTestApp(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{name: "malformed withdrawal without token", method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":1}`, wantStatus: http.StatusUnauthorized},
+		{name: "malformed order upload without token", method: http.MethodPost, path: "/api/v2/orders", body: `{}`, wantStatus: http.StatusUnauthorized},
+		{name: "malformed admin request without token", method: http.MethodPut, path: "/api/admin/users/alice/roles", body: `[]`, wantStatus: http.StatusUnauthorized},
+		{name: "malformed login", method: http.MethodPost, path: "/api/user/login", body: `{"login":1}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+// workerStorage keeps orders in memory and records what is published about
+// them.
+type workerStorage struct {
+	storage.Storage
+	orders     map[string]*models.Order
+	events     []string
+	deliveries []string
+}
+
+func (s *workerStorage) GetPendingOrders(context.Context, int) ([]string, error) {
+	var numbers []string
+	for number, order := range s.orders {
+		if order.Status == "NEW" || order.Status == "PROCESSING" {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers, nil
+}
+
+// SetOrderProcessing returns only the owners of orders that were NEW, like the
+// database does.
+func (s *workerStorage) SetOrderProcessing(_ context.Context, numbers []string) (map[string]int, error) {
+	userIDs := make(map[string]int)
+	for _, number := range numbers {
+		if order := s.orders[number]; order.Status == "NEW" {
+			order.Status = "PROCESSING"
+			userIDs[number] = order.UserID
+		}
+	}
+	return userIDs, nil
+}
+
+func (s *workerStorage) UpdateOrder(_ context.Context, number, status string, accrual float64) (int, bool, error) {
+	order := s.orders[number]
+	if order.Status == status && order.Accrual == accrual {
+		return order.UserID, false, nil
+	}
+	order.Status, order.Accrual = status, accrual
+	return order.UserID, true, nil
+}
+
+func (s *workerStorage) GetBalance(context.Context, int) (*models.Balance, error) {
+	return &models.Balance{}, nil
+}
+
+func (s *workerStorage) CreateEvent(_ context.Context, event *models.Event) error {
+	s.events = append(s.events, event.Type)
+	return nil
+}
+
+func (s *workerStorage) CreateWebhookDeliveries(_ context.Context, userID int, event string, _ []byte) error {
+	if userID != 7 {
+		return storage.ErrNotFound
+	}
+	s.deliveries = append(s.deliveries, event)
+	return nil
+}
+
+func TestProcessOrdersAcrossBatches(t *testing.T) {
+	answers := []string{
+		`{"order":"79927398713","status":"PROCESSING"}`,
+		`{"order":"79927398713","status":"PROCESSING"}`,
+		`{"order":"79927398713","status":"PROCESSED","accrual":500}`,
+	}
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(answers[0]))
+		answers = answers[1:]
+	}))
+	defer accrual.Close()
+
+	store := &workerStorage{orders: map[string]*models.Order{
+		"79927398713": {Number: "79927398713", Status: "NEW", UserID: 7},
+	}}
+	a := &App{
+		Storage:  store,
+		Accrual:  services.NewAccrualService(accrual.Client(), accrual.URL),
+		Events:   services.NewEventBroker(store, nil),
+		Webhooks: services.NewWebhookDispatcher(store, false),
+	}
+
+	wantEvents := [][]string{
+		{services.EventOrderStatus},
+		{services.EventOrderStatus},
+		{services.EventOrderStatus, services.EventOrderStatus, services.EventBalanceUpdated},
+	}
+	wantDeliveries := []int{0, 0, 1}
+	for i := range wantEvents {
+		if err := a.processOrdersBatch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(store.events, wantEvents[i]) {
+			t.Fatalf("pass %d: events = %v, want %v", i+1, store.events, wantEvents[i])
+		}
+		if len(store.deliveries) != wantDeliveries[i] {
+			t.Fatalf("pass %d: webhooks = %v", i+1, store.deliveries)
+		}
+	}
+	if store.deliveries[0] != services.WebhookOrderProcessed {
+		t.Fatalf("webhook = %s, want %s", store.deliveries[0], services.WebhookOrderProcessed)
+	}
+}
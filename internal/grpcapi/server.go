@@ -0,0 +1,366 @@
+// Package grpcapi serves the Gophermart gRPC API defined in
+// proto/gophermart.proto on top of the same storage as the HTTP API.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	md "gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/pb"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+	"gophermart/internal/validation"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	sessionTTL       = 24 * time.Hour
+)
+
+// publicMethods can be called without an access token.
+var publicMethods = map[string]bool{
+	pb.Gophermart_Register_FullMethodName: true,
+	pb.Gophermart_Login_FullMethodName:    true,
+}
+
+type userIDKey struct{}
+
+type Server struct {
+	pb.UnimplementedGophermartServer
+
+	storage storage.Storage
+	auth    *services.AuthService
+	orders  *services.OrderService
+	balance *services.BalanceService
+	policy  *validation.Policy
+	limiter *md.RateLimiter
+	// nil serves plain text
+	creds credentials.TransportCredentials
+}
+
+func NewServer(
+	storage storage.Storage,
+	auth *services.AuthService,
+	orders *services.OrderService,
+	balance *services.BalanceService,
+	policy *validation.Policy,
+	limiter *md.RateLimiter,
+	creds credentials.TransportCredentials,
+) *Server {
+	return &Server{
+		storage: storage,
+		auth:    auth,
+		orders:  orders,
+		balance: balance,
+		policy:  policy,
+		limiter: limiter,
+		creds:   creds,
+	}
+}
+
+// GRPCServer returns a gRPC server with the service registered and the rate
+// limiting and authentication interceptors installed, serving TLS if the
+// server has credentials.
+func (s *Server) GRPCServer() *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(s.rateLimit, s.authenticate)}
+	if s.creds != nil {
+		opts = append(opts, grpc.Creds(s.creds))
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterGophermartServer(srv, s)
+	return srv
+}
+
+// rateLimit applies the rate limits configured for the full method names,
+// e.g. /gophermart.v1.Gophermart/Login=10/1m, per user or per client IP like
+// the HTTP limiter.
+func (s *Server) rateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.limiter == nil {
+		return handler(ctx, req)
+	}
+
+	subject := "ip:" + clientIP(ctx)
+	if token, err := md.VerifyToken(bearerToken(ctx)); err == nil {
+		if id, ok := token.PrivateClaims()["user_id"].(float64); ok {
+			subject = "user:" + strconv.Itoa(int(id))
+		}
+	}
+
+	if retryAfter, ok := s.limiter.Allow(ctx, http.MethodPost, info.FullMethod, subject); !ok {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many requests, retry in %s", retryAfter)
+	}
+	return handler(ctx, req)
+}
+
+// authenticate checks the bearer token in the "authorization" metadata of
+// every call except Register and Login, applying the same rules as the HTTP
+// Authenticator.
+func (s *Server) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	token := bearerToken(ctx)
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing access token")
+	}
+
+	userID, ok, err := md.AuthenticateToken(ctx, s.storage, token)
+	if err != nil {
+		log.Printf("Failed to authenticate gRPC call %s: %v", info.FullMethod, err)
+		return nil, status.Error(codes.Internal, "failed to authenticate")
+	}
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired access token")
+	}
+
+	return handler(context.WithValue(ctx, userIDKey{}, userID), req)
+}
+
+func bearerToken(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		if scheme, rest, ok := strings.Cut(values[0], " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(rest)
+		}
+	}
+	return ""
+}
+
+func userID(ctx context.Context) int {
+	id, _ := ctx.Value(userIDKey{}).(int)
+	return id
+}
+
+func (s *Server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.AuthResponse, error) {
+	login, errs := s.policy.ValidateRegistration(req.GetLogin(), req.GetPassword())
+	if len(errs) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", errs[0].Field, errs[0].Message)
+	}
+
+	hashedPassword, err := utils.HashPassword(req.GetPassword())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to create user")
+	}
+
+	user := &models.User{Login: login, Password: hashedPassword}
+	if err := s.storage.CreateUser(ctx, user); err != nil {
+		if errors.Is(err, storage.ErrUserExists) {
+			return nil, status.Error(codes.AlreadyExists, "login already exists")
+		}
+		return nil, status.Error(codes.Internal, "failed to create user")
+	}
+
+	return s.startSession(ctx, user)
+}
+
+func (s *Server) Login(ctx context.Context, req *pb.LoginRequest) (*pb.AuthResponse, error) {
+	login := validation.NormalizeLogin(req.GetLogin())
+	if login == "" || req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "login and password are required")
+	}
+
+	user, err := s.auth.Login(ctx, login, req.GetPassword(), req.GetTwoFactorCode(), clientIP(ctx))
+	if err != nil {
+		var locked *services.LoginLockedError
+		switch {
+		case errors.As(err, &locked):
+			return nil, status.Error(codes.ResourceExhausted, locked.Error())
+		case errors.Is(err, services.ErrInvalidCredentials):
+			return nil, status.Error(codes.Unauthenticated, "invalid login or password")
+		case errors.Is(err, services.ErrTwoFactorRequired):
+			return nil, status.Error(codes.FailedPrecondition, "two-factor code required")
+		case errors.Is(err, services.ErrInvalidCode):
+			return nil, status.Error(codes.Unauthenticated, "invalid two-factor code")
+		case errors.Is(err, services.ErrTwoFactorLocked):
+			return nil, status.Error(codes.ResourceExhausted, "too many invalid two-factor codes")
+		default:
+			return nil, status.Error(codes.Internal, "failed to authenticate")
+		}
+	}
+
+	return s.startSession(ctx, user)
+}
+
+// startSession records a session like an HTTP login does, so it is listed
+// and can be revoked with the user's other sessions.
+func (s *Server) startSession(ctx context.Context, user *models.User) (*pb.AuthResponse, error) {
+	sessionID, err := utils.RandomToken(16)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate token")
+	}
+
+	now := time.Now()
+	var userAgent string
+	if values := metadata.ValueFromIncomingContext(ctx, "user-agent"); len(values) > 0 {
+		userAgent = values[0]
+	}
+	session := &models.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		Device:     "gRPC client",
+		IP:         clientIP(ctx),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionTTL),
+	}
+	if err := s.storage.CreateSession(ctx, session); err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate token")
+	}
+
+	token, err := md.GenerateToken(user, session)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to generate token")
+	}
+
+	return &pb.AuthResponse{AccessToken: token, ExpiresAt: timestamppb.New(session.ExpiresAt)}, nil
+}
+
+func (s *Server) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	order, created, err := s.orders.Upload(ctx, userID(ctx), strings.TrimSpace(req.GetNumber()))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidOrderNumber):
+			return nil, status.Error(codes.InvalidArgument, "invalid order number")
+		case errors.Is(err, services.ErrOrderOwnedByOtherUser):
+			return nil, status.Error(codes.AlreadyExists, "order already uploaded by another user")
+		default:
+			return nil, status.Error(codes.Internal, "failed to save order")
+		}
+	}
+
+	return &pb.UploadOrderResponse{Order: toOrder(*order), Created: created}, nil
+}
+
+func (s *Server) ListOrders(ctx context.Context, req *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	limit, offset, err := pageParams(req.GetLimit(), req.GetOffset())
+	if err != nil {
+		return nil, err
+	}
+
+	orders, total, err := s.storage.GetOrdersPage(ctx, userID(ctx), limit, offset)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get orders")
+	}
+
+	resp := &pb.ListOrdersResponse{Orders: make([]*pb.Order, len(orders)), Total: int32(total)}
+	for i, order := range orders {
+		resp.Orders[i] = toOrder(order)
+	}
+	return resp, nil
+}
+
+func (s *Server) GetBalance(ctx context.Context, _ *pb.GetBalanceRequest) (*pb.Balance, error) {
+	balance, err := s.storage.GetBalance(ctx, userID(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get balance")
+	}
+	return &pb.Balance{
+		Current:   utils.FormatAmount(balance.Current),
+		Withdrawn: utils.FormatAmount(balance.Withdrawn),
+	}, nil
+}
+
+func (s *Server) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.Withdrawal, error) {
+	sum, err := utils.ParseAmount(req.GetSum())
+	if err != nil || sum <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "sum must be a positive decimal string")
+	}
+
+	processedAt, err := s.balance.Withdraw(ctx, userID(ctx), req.GetOrder(), sum, req.GetTwoFactorCode())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidOrderNumber):
+			return nil, status.Error(codes.InvalidArgument, "invalid order number")
+		case errors.Is(err, services.ErrTwoFactorRequired):
+			return nil, status.Error(codes.PermissionDenied, "two-factor code required")
+		case errors.Is(err, services.ErrTwoFactorLocked):
+			return nil, status.Error(codes.ResourceExhausted, "too many invalid two-factor codes")
+		case errors.Is(err, storage.ErrInsufficientFunds):
+			return nil, status.Error(codes.FailedPrecondition, "insufficient funds")
+		case errors.Is(err, storage.ErrDuplicateWithdrawal):
+			return nil, status.Error(codes.AlreadyExists, "order number already used")
+		default:
+			return nil, status.Error(codes.Internal, "failed to process withdrawal")
+		}
+	}
+
+	return &pb.Withdrawal{
+		Order:       req.GetOrder(),
+		Sum:         utils.FormatAmount(sum),
+		ProcessedAt: timestamppb.New(processedAt),
+	}, nil
+}
+
+func (s *Server) ListWithdrawals(ctx context.Context, req *pb.ListWithdrawalsRequest) (*pb.ListWithdrawalsResponse, error) {
+	limit, offset, err := pageParams(req.GetLimit(), req.GetOffset())
+	if err != nil {
+		return nil, err
+	}
+
+	withdrawals, total, err := s.storage.GetWithdrawalsPage(ctx, userID(ctx), limit, offset)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get withdrawals")
+	}
+
+	resp := &pb.ListWithdrawalsResponse{Withdrawals: make([]*pb.Withdrawal, len(withdrawals)), Total: int32(total)}
+	for i, w := range withdrawals {
+		resp.Withdrawals[i] = &pb.Withdrawal{
+			Order:       w.Order,
+			Sum:         utils.FormatAmount(w.Sum),
+			ProcessedAt: timestamppb.New(w.ProcessedAt),
+		}
+	}
+	return resp, nil
+}
+
+func toOrder(order models.Order) *pb.Order {
+	return &pb.Order{
+		Number:     order.Number,
+		Status:     order.Status,
+		Accrual:    utils.FormatAmount(order.Accrual),
+		UploadedAt: timestamppb.New(order.UploadedAt),
+	}
+}
+
+func pageParams(limit, offset int32) (int, int, error) {
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit < 0 || limit > maxPageLimit {
+		return 0, 0, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", maxPageLimit)
+	}
+	if offset < 0 {
+		return 0, 0, status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+	return int(limit), int(offset), nil
+}
+
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
@@ -0,0 +1,109 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	md "gophermart/internal/middleware"
+	"gophermart/internal/pb"
+	"gophermart/internal/validation"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serve starts the server on a local port and returns a client connected
+// with the given credentials.
+func serve(t *testing.T, s *Server, creds credentials.TransportCredentials) pb.GophermartClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := s.GRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewGophermartClient(conn)
+}
+
+func newTestServer(t *testing.T, limits string, creds credentials.TransportCredentials) *Server {
+	t.Helper()
+	policy, err := validation.NewPolicy(`^[a-z]{3,64}$`, 8, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rateLimits, err := md.ParseRateLimits(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := md.NewRateLimiter(md.NewMemoryRateLimitStore(), rateLimits)
+	// Register with an invalid password never reaches the storage.
+	return NewServer(nil, nil, nil, nil, policy, limiter, creds)
+}
+
+func TestServerTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	s := newTestServer(t, "", credentials.NewServerTLSFromCert(&cert))
+	req := &pb.RegisterRequest{Login: "alice", Password: "short"}
+
+	client := serve(t, s, credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}))
+	if _, err := client.Register(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("over TLS: err = %v, want InvalidArgument", err)
+	}
+
+	plain := serve(t, s, insecure.NewCredentials())
+	if _, err := plain.Register(context.Background(), req); status.Code(err) != codes.Unavailable {
+		t.Fatalf("plain text: err = %v, want Unavailable", err)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := newTestServer(t, "/gophermart.v1.Gophermart/Register=2/1m", nil)
+	client := serve(t, s, insecure.NewCredentials())
+	req := &pb.RegisterRequest{Login: "alice", Password: "short"}
+
+	for i, want := range []codes.Code{codes.InvalidArgument, codes.InvalidArgument, codes.ResourceExhausted} {
+		if _, err := client.Register(context.Background(), req); status.Code(err) != want {
+			t.Fatalf("call %d: err = %v, want %v", i+1, err, want)
+		}
+	}
+	if _, err := client.Login(context.Background(), &pb.LoginRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("other method: err = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+type AccountHandler struct {
+	storage   storage.Storage
+	twoFactor *services.TwoFactorService
+}
+
+func NewAccountHandler(storage storage.Storage, twoFactor *services.TwoFactorService) *AccountHandler {
+	return &AccountHandler{storage: storage, twoFactor: twoFactor}
+}
+
+type accountExport struct {
+	ExportedAt     time.Time                   `json:"exported_at"`
+	Profile        *models.Profile             `json:"profile"`
+	Balance        *models.Balance             `json:"balance"`
+	Orders         []models.Order              `json:"orders"`
+	Withdrawals    []models.Withdrawal         `json:"withdrawals"`
+	BalanceHistory []models.BalanceTransaction `json:"balance_history"`
+}
+
+// Export returns everything stored about the user as one JSON document, or as
+// a ZIP archive with one file per section when format=zip is requested.
+func (h *AccountHandler) Export(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "application/zip") {
+		format = "zip"
+	}
+	if format != "" && format != "json" && format != "zip" {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeUnsupportedFormat, "Unsupported format, use json or zip")
+		return
+	}
+
+	export, err := h.collect(r, userID)
+	if err != nil {
+		log.Printf("Failed to export data of user %d: %v", userID, err)
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to export data")
+		return
+	}
+
+	filename := fmt.Sprintf("gophermart-export-%s", export.ExportedAt.Format("20060102"))
+	if format != "zip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+	zw := zip.NewWriter(w)
+	for _, file := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"balance.json", export.Balance},
+		{"orders.json", export.Orders},
+		{"withdrawals.json", export.Withdrawals},
+		{"balance_history.json", export.BalanceHistory},
+	} {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			log.Printf("Failed to write export archive: %v", err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.v); err != nil {
+			log.Printf("Failed to write export archive: %v", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to write export archive: %v", err)
+	}
+}
+
+func (h *AccountHandler) collect(r *http.Request, userID int) (*accountExport, error) {
+	ctx := r.Context()
+	export := &accountExport{ExportedAt: time.Now().UTC()}
+
+	var err error
+	if export.Profile, err = h.storage.GetProfile(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Balance, err = h.storage.GetBalance(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Orders, err = h.storage.GetOrders(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Withdrawals, err = h.storage.GetWithdrawals(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Orders == nil {
+		export.Orders = []models.Order{}
+	}
+	if export.Withdrawals == nil {
+		export.Withdrawals = []models.Withdrawal{}
+	}
+	if export.BalanceHistory, err = h.balanceHistory(r, userID, export.ExportedAt); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// historyPageSize is how many balance transactions the export reads at once.
+const historyPageSize = 500
+
+// balanceHistory returns the user's balance transactions made before the
+// export, oldest first.
+func (h *AccountHandler) balanceHistory(r *http.Request, userID int, before time.Time) ([]models.BalanceTransaction, error) {
+	history := []models.BalanceTransaction{}
+	filter := models.BalanceHistoryFilter{To: before}
+	for {
+		page, total, err := h.storage.GetBalanceHistory(r.Context(), userID, filter, historyPageSize, len(history))
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, page...)
+		if len(page) == 0 || len(history) >= total {
+			break
+		}
+	}
+	slices.Reverse(history)
+	return history, nil
+}
+
+// recentLogin is how recent the login of a user without a password must be to
+// delete the account.
+const recentLogin = 5 * time.Minute
+
+// Delete erases the account. Users with a password must confirm it, users with
+// two-factor authentication also give a code. Users registered through an
+// identity provider have no password; without two-factor authentication they
+// must have logged in within recentLogin.
+func (h *AccountHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		TOTPCode string `json:"totp_code"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+			return
+		}
+	}
+
+	user, err := h.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to delete account")
+		return
+	}
+
+	if user.Password != "!" && !utils.CheckPasswordHash(req.Password, user.Password) {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeInvalidPassword, "Invalid password")
+		return
+	}
+	if user.Password == "!" && !user.TwoFactorEnabled && time.Since(middleware.GetLoginTimeFromToken(r)) > recentLogin {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeReauthRequired, "Log in again to delete the account")
+		return
+	}
+	if user.TwoFactorEnabled {
+		if err := h.twoFactor.Verify(r.Context(), userID, req.TOTPCode); err != nil {
+			switch {
+			case errors.Is(err, services.ErrInvalidCode):
+				problem.Error(w, r, http.StatusForbidden, problem.CodeInvalidTwoFactorCode, "Invalid two-factor code")
+			case errors.Is(err, services.ErrTwoFactorLocked):
+				problem.Error(w, r, http.StatusTooManyRequests, problem.CodeTwoFactorLocked, "Too many invalid two-factor codes")
+			default:
+				problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to delete account")
+			}
+			return
+		}
+	}
+
+	if err := h.storage.DeleteUser(r.Context(), userID); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		} else {
+			log.Printf("Failed to delete user %d: %v", userID, err)
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to delete account")
+		}
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
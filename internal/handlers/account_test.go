@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+type deleteStorage struct {
+	storage.Storage
+	user    models.User
+	deleted bool
+}
+
+func (s *deleteStorage) GetUserByID(context.Context, int) (*models.User, error) {
+	user := s.user
+	return &user, nil
+}
+
+func (s *deleteStorage) DeleteUser(context.Context, int) error {
+	s.deleted = true
+	return nil
+}
+
+func TestDeleteAccount(t *testing.T) {
+	hash, err := utils.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		password   string
+		loggedIn   time.Duration
+		body       string
+		wantStatus int
+	}{
+		{name: "password", password: hash, loggedIn: time.Hour, body: `{"password":"correct horse"}`, wantStatus: http.StatusNoContent},
+		{name: "wrong password", password: hash, loggedIn: time.Minute, body: `{"password":"wrong"}`, wantStatus: http.StatusForbidden},
+		{name: "external identity after a fresh login", password: "!", loggedIn: time.Minute, wantStatus: http.StatusNoContent},
+		{name: "external identity after an old login", password: "!", loggedIn: time.Hour, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &deleteStorage{user: models.User{ID: 1, Login: "alice", Password: tt.password}}
+			h := NewAccountHandler(store, nil)
+
+			token := jwt.New()
+			token.Set("user_id", float64(1))
+			token.Set(jwt.IssuedAtKey, time.Now().Add(-tt.loggedIn))
+			r := httptest.NewRequest(http.MethodDelete, "/api/user", strings.NewReader(tt.body))
+			r = r.WithContext(jwtauth.NewContext(r.Context(), token, nil))
+
+			w := httptest.NewRecorder()
+			h.Delete(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if store.deleted != (tt.wantStatus == http.StatusNoContent) {
+				t.Fatalf("deleted = %v", store.deleted)
+			}
+		})
+	}
+}
+
+// historyStorage serves an account with the given number of balance
+// transactions, one a minute, ids in the order they were made.
+type historyStorage struct {
+	storage.Storage
+	transactions int
+	filters      []models.BalanceHistoryFilter
+}
+
+func (s *historyStorage) GetProfile(context.Context, int) (*models.Profile, error) {
+	return &models.Profile{}, nil
+}
+
+func (s *historyStorage) GetBalance(context.Context, int) (*models.Balance, error) {
+	return &models.Balance{}, nil
+}
+
+func (s *historyStorage) GetOrders(context.Context, int) ([]models.Order, error) {
+	return nil, nil
+}
+
+func (s *historyStorage) GetWithdrawals(context.Context, int) ([]models.Withdrawal, error) {
+	return nil, nil
+}
+
+func (s *historyStorage) GetBalanceHistory(_ context.Context, userID int, filter models.BalanceHistoryFilter, limit, offset int) ([]models.BalanceTransaction, int, error) {
+	s.filters = append(s.filters, filter)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	page := []models.BalanceTransaction{}
+	for i := s.transactions - offset; i > 0 && len(page) < limit; i-- {
+		page = append(page, models.BalanceTransaction{
+			ID:        int64(i),
+			UserID:    userID,
+			Type:      models.TransactionAccrual,
+			Amount:    1,
+			Balance:   float64(i),
+			CreatedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	return page, s.transactions, nil
+}
+
+func TestExportBalanceHistory(t *testing.T) {
+	for _, n := range []int{0, 1, historyPageSize, historyPageSize*2 + 1} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			store := &historyStorage{transactions: n}
+			h := NewAccountHandler(store, nil)
+
+			w := httptest.NewRecorder()
+			h.Export(w, withUser(t, httptest.NewRequest(http.MethodGet, "/api/user/export", nil), 1))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var export accountExport
+			if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+				t.Fatal(err)
+			}
+			if export.BalanceHistory == nil || len(export.BalanceHistory) != n {
+				t.Fatalf("got %d transactions, want %d", len(export.BalanceHistory), n)
+			}
+			for i, tx := range export.BalanceHistory {
+				if tx.ID != int64(i+1) {
+					t.Fatalf("transaction %d has id %d, want oldest first", i, tx.ID)
+				}
+			}
+			for _, filter := range store.filters {
+				if !filter.To.Equal(export.ExportedAt) {
+					t.Fatalf("history read up to %v, exported at %v", filter.To, export.ExportedAt)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/validation"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AdminHandler struct {
+	storage storage.Storage
+	guard   *services.LoginGuard
+}
+
+func NewAdminHandler(storage storage.Storage, guard *services.LoginGuard) *AdminHandler {
+	return &AdminHandler{storage: storage, guard: guard}
+}
+
+type adminUser struct {
+	ID               int      `json:"id"`
+	Login            string   `json:"login"`
+	Roles            []string `json:"roles"`
+	TwoFactorEnabled bool     `json:"two_factor_enabled"`
+}
+
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.storage.GetUserByLogin(r.Context(), validation.NormalizeLogin(chi.URLParam(r, "login")))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get user")
+		}
+		return
+	}
+
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+
+	render.Write(w, r, http.StatusOK, adminUser{
+		ID:               user.ID,
+		Login:            user.Login,
+		Roles:            roles,
+		TwoFactorEnabled: user.TwoFactorEnabled,
+	})
+}
+
+// SetRoles replaces the roles of a user. The user has to log in again for the
+// change to show up in the token.
+func (h *AdminHandler) SetRoles(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+	for _, role := range req.Roles {
+		if !slices.Contains(models.Roles, role) {
+			problem.Validation(w, r, []problem.FieldError{{Field: "roles", Code: "unknown_role", Message: "Unknown role " + role}})
+			return
+		}
+	}
+
+	user, err := h.storage.GetUserByLogin(r.Context(), validation.NormalizeLogin(chi.URLParam(r, "login")))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to set roles")
+		}
+		return
+	}
+
+	if err := h.storage.SetUserRoles(r.Context(), user.ID, req.Roles); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to set roles")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlockLogin clears failed login attempts and lockouts of a login or client IP.
+func (h *AdminHandler) UnlockLogin(w http.ResponseWriter, r *http.Request) {
+	if err := h.guard.Unlock(r.Context(), chi.URLParam(r, "key")); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to unlock")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
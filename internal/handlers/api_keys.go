@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type APIKeyHandler struct {
+	storage storage.Storage
+}
+
+func NewAPIKeyHandler(storage storage.Storage) *APIKeyHandler {
+	return &APIKeyHandler{storage: storage}
+}
+
+// CreateKey issues a new partner API key. The key itself is only returned in
+// this response.
+func (h *APIKeyHandler) CreateKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Name        string   `json:"name"`
+		Scopes      []string `json:"scopes"`
+		QuotaPerDay int      `json:"quota_per_day"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		problem.Validation(w, r, []problem.FieldError{{Field: "name", Code: "required", Message: "Name is required"}})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		problem.Validation(w, r, []problem.FieldError{{Field: "scopes", Code: "required", Message: "At least one scope is required"}})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(middleware.Scopes, scope) {
+			problem.Validation(w, r, []problem.FieldError{{Field: "scopes", Code: "unknown_scope", Message: "Unknown scope " + scope}})
+			return
+		}
+	}
+	if req.QuotaPerDay < 0 {
+		problem.Validation(w, r, []problem.FieldError{{Field: "quota_per_day", Code: "negative", Message: "Quota must not be negative"}})
+		return
+	}
+
+	rawKey, prefix, err := middleware.NewAPIKey()
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to create API key")
+		return
+	}
+
+	key := models.APIKey{
+		UserID:      userID,
+		Name:        req.Name,
+		Prefix:      prefix,
+		Hash:        utils.HashToken(rawKey),
+		Scopes:      req.Scopes,
+		QuotaPerDay: req.QuotaPerDay,
+		CreatedAt:   time.Now(),
+	}
+	if err := h.storage.CreateAPIKey(r.Context(), &key); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to create API key")
+		return
+	}
+
+	render.Write(w, r, http.StatusCreated, struct {
+		models.APIKey
+		Key string `json:"key"`
+	}{key, rawKey})
+}
+
+func (h *APIKeyHandler) GetKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	keys, err := h.storage.GetAPIKeys(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get API keys")
+		return
+	}
+
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, keys)
+}
+
+func (h *APIKeyHandler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid API key ID")
+		return
+	}
+
+	if err := h.storage.RevokeAPIKey(r.Context(), userID, id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "API key not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke API key")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,105 +3,222 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	md "gophermart/internal/middleware"
 	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
 	"gophermart/internal/storage"
 	"gophermart/internal/utils"
+	"gophermart/internal/validation"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
 type AuthHandler struct {
 	storage storage.Storage
+	auth    *services.AuthService
+	policy  *validation.Policy
 }
 
-func NewAuthHandler(storage storage.Storage) *AuthHandler {
-	return &AuthHandler{storage: storage}
+func NewAuthHandler(storage storage.Storage, auth *services.AuthService, policy *validation.Policy) *AuthHandler {
+	return &AuthHandler{storage: storage, auth: auth, policy: policy}
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var user models.User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
 		return
 	}
 
+	login, errs := h.policy.ValidateRegistration(user.Login, user.Password)
+	if len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+	user.Login = login
+
 	hashedPassword, err := utils.HashPassword(user.Password)
 	if err != nil {
-		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to create user")
 		return
 	}
 
 	user.Password = hashedPassword
 	if err := h.storage.CreateUser(r.Context(), &user); err != nil {
 		if errors.Is(err, storage.ErrUserExists) {
-			http.Error(w, "Login already exists", http.StatusConflict)
+			problem.Error(w, r, http.StatusConflict, problem.CodeUserExists, "Login already exists")
 		} else {
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to create user")
 		}
 		return
 	}
 
-	tokenString, err := md.GenerateToken(user.ID)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+	if err := startSession(w, r, h.storage, &user); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
 		return
 	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    tokenString,
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-	})
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	var reqUser models.User
 	if err := json.NewDecoder(r.Body).Decode(&reqUser); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
 		return
 	}
 
+	reqUser.Login = validation.NormalizeLogin(reqUser.Login)
 	if reqUser.Login == "" || reqUser.Password == "" {
-		http.Error(w, "Login and password are required", http.StatusBadRequest)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Login and password are required")
 		return
 	}
 
-	dbUser, err := h.storage.GetUserByLogin(r.Context(), reqUser.Login)
+	dbUser, err := h.auth.Login(r.Context(), reqUser.Login, reqUser.Password, "", md.ClientIP(r))
+	if errors.Is(err, services.ErrTwoFactorRequired) {
+		mfaToken, err := md.GenerateMFAToken(dbUser)
+		if err != nil {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
+			return
+		}
+		render.Write(w, r, http.StatusAccepted, map[string]string{"mfa_token": mfaToken})
+		return
+	}
+	if err != nil {
+		loginFailed(w, r, err)
+		return
+	}
+
+	if err := startSession(w, r, h.storage, dbUser); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// loginFailed writes the response for an error from the AuthService.
+func loginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var locked *services.LoginLockedError
+	switch {
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+		problem.Error(w, r, http.StatusTooManyRequests, problem.CodeLoginLocked, "Too many failed login attempts")
+	case errors.Is(err, services.ErrInvalidCredentials):
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid login or password")
+	case errors.Is(err, services.ErrInvalidCode):
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeInvalidTwoFactorCode, "Invalid two-factor code")
+	case errors.Is(err, services.ErrTwoFactorLocked):
+		problem.Error(w, r, http.StatusTooManyRequests, problem.CodeTwoFactorLocked, "Too many invalid two-factor codes")
+	default:
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to authenticate")
+	}
+}
+
+// LoginTwoFactor completes a login of a user with two-factor authentication by
+// exchanging the token returned from Login and a TOTP or recovery code.
+func (h *AuthHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	userID, version, err := md.ParseMFAToken(req.MFAToken)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid or expired two-factor token")
+		return
+	}
+
+	user, err := h.storage.GetUserByID(r.Context(), userID)
 	if err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
-			http.Error(w, "Invalid login or password", http.StatusUnauthorized)
+			problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid or expired two-factor token")
 		} else {
-			http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to authenticate")
 		}
 		return
 	}
+	if user.TokenVersion != version {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid or expired two-factor token")
+		return
+	}
 
-	if !utils.CheckPasswordHash(reqUser.Password, dbUser.Password) {
-		http.Error(w, "Invalid login or password", http.StatusUnauthorized)
+	if err := h.auth.SecondFactor(r.Context(), user, req.Code, md.ClientIP(r)); err != nil {
+		loginFailed(w, r, err)
 		return
 	}
 
-	tokenString, err := md.GenerateToken(dbUser.ID)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+	if err := startSession(w, r, h.storage, user); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+}
+
+// startSession records a new session for the user and sets the auth cookie
+// with a token bound to it.
+func startSession(w http.ResponseWriter, r *http.Request, store storage.Storage, user *models.User) error {
+	sessionID, err := utils.RandomToken(16)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	userAgent := r.UserAgent()
+	device := strings.TrimSpace(r.Header.Get("X-Device-Name"))
+	if device == "" {
+		device = utils.DescribeUserAgent(userAgent)
+	}
+	session := &models.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		Device:     device,
+		IP:         md.ClientIP(r),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(24 * time.Hour),
+	}
+	if err := store.CreateSession(r.Context(), session); err != nil {
+		return err
+	}
+
+	tokenString, err := md.GenerateToken(user, session)
+	if err != nil {
+		return err
+	}
+
+	csrfToken, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "auth_token",
 		Value:    tokenString,
 		Path:     "/",
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  session.ExpiresAt,
 	})
-
-	w.WriteHeader(http.StatusOK)
-}
\ No newline at end of file
+	// Readable by scripts so browser clients can echo it in the X-CSRF-Token header.
+	http.SetCookie(w, &http.Cookie{
+		Name:     md.CSRFCookie,
+		Value:    csrfToken,
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+		Expires:  session.ExpiresAt,
+	})
+	return nil
+}
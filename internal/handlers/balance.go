@@ -4,8 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
 	"gophermart/internal/storage"
 	"gophermart/internal/utils"
 
@@ -14,88 +21,229 @@ import (
 
 type BalanceHandler struct {
 	storage storage.Storage
+	balance *services.BalanceService
 }
 
-func NewBalanceHandler(storage storage.Storage) *BalanceHandler {
-	return &BalanceHandler{storage: storage}
+func NewBalanceHandler(storage storage.Storage, balance *services.BalanceService) *BalanceHandler {
+	return &BalanceHandler{storage: storage, balance: balance}
 }
 
 func (h *BalanceHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	userID, err := middleware.GetUserIDFromToken(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	balance, err := h.storage.GetBalance(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "Failed to get balance", http.StatusInternalServerError)
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get balance")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(balance)
+	render.Write(w, r, http.StatusOK, balance)
 }
 
 func (h *BalanceHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
 	userID, err := middleware.GetUserIDFromToken(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	var withdrawal struct {
-		Order string  `json:"order"`
-		Sum   float64 `json:"sum"`
+		Order    string  `json:"order"`
+		Sum      float64 `json:"sum"`
+		TOTPCode string  `json:"totp_code,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&withdrawal); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
 		return
 	}
 
-	if withdrawal.Sum <= 0 {
-		http.Error(w, "Sum must be positive", http.StatusBadRequest)
+	if _, ok := h.withdraw(w, r, userID, withdrawal.Order, withdrawal.Sum, withdrawal.TOTPCode); !ok {
 		return
 	}
 
-	if !utils.IsValidLuhn(withdrawal.Order) {
-		http.Error(w, "Invalid order number format", http.StatusUnprocessableEntity)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *BalanceHandler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	withdrawals, err := h.storage.GetWithdrawals(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get withdrawals")
+		return
+	}
+
+	if len(withdrawals) == 0 {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	if err := h.storage.ProcessWithdrawal(r.Context(), userID, withdrawal.Order, withdrawal.Sum); err != nil {
+	render.Write(w, r, http.StatusOK, withdrawals)
+}
+
+// withdraw records the withdrawal and returns its time. The two-factor code
+// is taken from the body or the X-TOTP-Code header. On failure it writes the
+// error response and returns false.
+func (h *BalanceHandler) withdraw(w http.ResponseWriter, r *http.Request, userID int, order string, sum float64, totpCode string) (time.Time, bool) {
+	if totpCode == "" {
+		totpCode = r.Header.Get("X-TOTP-Code")
+	}
+	processedAt, err := h.balance.Withdraw(r.Context(), userID, order, sum, totpCode)
+	if err != nil {
 		switch {
+		case errors.Is(err, services.ErrInvalidAmount):
+			problem.Validation(w, r, []problem.FieldError{{Field: "sum", Code: "not_positive", Message: "Sum must be positive"}})
+		case errors.Is(err, services.ErrInvalidOrderNumber):
+			problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidOrderNumber, "Invalid order number format")
 		case errors.Is(err, storage.ErrInsufficientFunds):
-			http.Error(w, "Insufficient funds", http.StatusPaymentRequired)
+			problem.Error(w, r, http.StatusPaymentRequired, problem.CodeInsufficientFunds, "Insufficient funds")
 		case errors.Is(err, storage.ErrDuplicateWithdrawal):
-			http.Error(w, "Order number already used", http.StatusConflict)
-		default:
-			http.Error(w, "Failed to process withdrawal", http.StatusInternalServerError)
+			problem.Error(w, r, http.StatusConflict, problem.CodeDuplicateWithdrawal, "Order number already used")
+		case !twoFactorFailed(w, r, err):
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to process withdrawal")
 		}
-		return
+		return time.Time{}, false
 	}
+	return processedAt, true
+}
 
-	w.WriteHeader(http.StatusOK)
+// twoFactorFailed writes the response for a missing, wrong or locked out
+// two-factor code and reports whether err was one of those.
+func twoFactorFailed(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, services.ErrTwoFactorRequired):
+		problem.Error(w, r, http.StatusForbidden, problem.CodeTwoFactorRequired, "Two-factor code required")
+	case errors.Is(err, services.ErrTwoFactorLocked):
+		problem.Error(w, r, http.StatusTooManyRequests, problem.CodeTwoFactorLocked, "Too many invalid two-factor codes")
+	default:
+		return false
+	}
+	return true
 }
 
-func (h *BalanceHandler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
+// Transfer moves points to another user. Repeating a request with the same
+// idempotency key returns the original transfer with 200 instead of 201.
+func (h *BalanceHandler) Transfer(w http.ResponseWriter, r *http.Request) {
 	userID, err := middleware.GetUserIDFromToken(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	withdrawals, err := h.storage.GetWithdrawals(r.Context(), userID)
+	var req struct {
+		Recipient      string      `json:"recipient"`
+		Amount         json.Number `json:"amount"`
+		IdempotencyKey string      `json:"idempotency_key"`
+		TOTPCode       string      `json:"totp_code,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	var errs []problem.FieldError
+	if strings.TrimSpace(req.Recipient) == "" {
+		errs = append(errs, problem.FieldError{Field: "recipient", Code: "required", Message: "Recipient is required"})
+	}
+	amount, err := utils.ParseAmount(req.Amount.String())
+	if req.Amount == "" {
+		errs = append(errs, problem.FieldError{Field: "amount", Code: "required", Message: "Amount is required"})
+	} else if err != nil {
+		errs = append(errs, problem.FieldError{Field: "amount", Code: "invalid_amount", Message: "Amount must be a number with at most two decimal places"})
+	} else if amount <= 0 {
+		errs = append(errs, problem.FieldError{Field: "amount", Code: "not_positive", Message: "Amount must be positive"})
+	}
+	if req.IdempotencyKey == "" || len(req.IdempotencyKey) > 255 {
+		errs = append(errs, problem.FieldError{Field: "idempotency_key", Code: "invalid_length", Message: "Idempotency key must be 1 to 255 characters"})
+	}
+	if len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	code := req.TOTPCode
+	if code == "" {
+		code = r.Header.Get("X-TOTP-Code")
+	}
+	transfer := &models.Transfer{
+		SenderID:       userID,
+		Recipient:      strings.TrimSpace(req.Recipient),
+		Amount:         amount,
+		IdempotencyKey: req.IdempotencyKey,
+	}
+	created, err := h.balance.Transfer(r.Context(), transfer, code)
 	if err != nil {
-		http.Error(w, "Failed to get withdrawals", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeRecipientNotFound, "Recipient not found")
+		case errors.Is(err, storage.ErrSelfTransfer):
+			problem.Validation(w, r, []problem.FieldError{{Field: "recipient", Code: "self", Message: "Cannot transfer to yourself"}})
+		case errors.Is(err, storage.ErrIdempotencyKeyReused):
+			problem.Error(w, r, http.StatusConflict, problem.CodeIdempotencyKeyReused, "Idempotency key already used for a different transfer")
+		case errors.Is(err, storage.ErrTransferLimitExceeded):
+			problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeTransferLimitExceeded, "Daily transfer limit exceeded")
+		case errors.Is(err, storage.ErrInsufficientFunds):
+			problem.Error(w, r, http.StatusPaymentRequired, problem.CodeInsufficientFunds, "Insufficient funds")
+		case !twoFactorFailed(w, r, err):
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to transfer points")
+		}
 		return
 	}
 
-	if len(withdrawals) == 0 {
-		w.WriteHeader(http.StatusNoContent)
+	if !created {
+		render.Write(w, r, http.StatusOK, transfer)
 		return
 	}
+	render.Write(w, r, http.StatusCreated, transfer)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(withdrawals)
-}
\ No newline at end of file
+// GetHistory lists the user's balance transactions, newest first, with the
+// balance after each of them. The type query parameter takes a comma-separated
+// list of transaction types. Amounts are numbers like in the other v1
+// balance endpoints; only /api/v2 and gRPC use decimal strings.
+func (h *BalanceHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var filter models.BalanceHistoryFilter
+	var errs []problem.FieldError
+	if s := r.URL.Query().Get("type"); s != "" {
+		for _, t := range strings.Split(s, ",") {
+			if !slices.Contains(models.TransactionTypes, t) {
+				errs = append(errs, problem.FieldError{Field: "type", Code: "unsupported", Message: "Type must be one of " + strings.Join(models.TransactionTypes, ", ")})
+				break
+			}
+			filter.Types = append(filter.Types, t)
+		}
+	}
+	var dateErrs []problem.FieldError
+	filter.From, filter.To, dateErrs = dateRangeParams(r)
+	if errs = append(errs, dateErrs...); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	transactions, total, err := h.storage.GetBalanceHistory(r.Context(), userID, filter, limit, offset)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get balance history")
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, newPage(transactions, limit, offset, total))
+}
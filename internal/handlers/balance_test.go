@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+)
+
+// transferStorage records the transfers made through it.
+type transferStorage struct {
+	storage.Storage
+	transfers []models.Transfer
+}
+
+func (s *transferStorage) Transfer(_ context.Context, transfer *models.Transfer, _ models.TransferLimits) (bool, error) {
+	transfer.ID = int64(len(s.transfers) + 1)
+	transfer.RecipientID = 2
+	s.transfers = append(s.transfers, *transfer)
+	return true, nil
+}
+
+func (s *transferStorage) GetBalance(context.Context, int) (*models.Balance, error) {
+	return &models.Balance{}, nil
+}
+
+func (s *transferStorage) CreateEvent(context.Context, *models.Event) error {
+	return nil
+}
+
+func (s *transferStorage) CreateWebhookDeliveries(context.Context, int, string, []byte) error {
+	return nil
+}
+
+func TestTransferAmount(t *testing.T) {
+	tests := []struct {
+		name       string
+		amount     string
+		wantStatus int
+		wantAmount float64
+		wantCode   string
+	}{
+		{name: "whole", amount: `100`, wantStatus: http.StatusCreated, wantAmount: 100},
+		{name: "cents", amount: `12.34`, wantStatus: http.StatusCreated, wantAmount: 12.34},
+		{name: "fractions of a cent", amount: `0.001`, wantStatus: http.StatusBadRequest, wantCode: "invalid_amount"},
+		{name: "exponent", amount: `1e2`, wantStatus: http.StatusBadRequest, wantCode: "invalid_amount"},
+		{name: "negative", amount: `-5`, wantStatus: http.StatusBadRequest, wantCode: "invalid_amount"},
+		{name: "zero", amount: `0`, wantStatus: http.StatusBadRequest, wantCode: "not_positive"},
+		{name: "missing", amount: ``, wantStatus: http.StatusBadRequest, wantCode: "required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &transferStorage{}
+			balance := services.NewBalanceService(store, nil, services.NewEventBroker(store, nil), services.NewWebhookDispatcher(store, false), 0, models.TransferLimits{})
+			h := NewBalanceHandler(store, balance)
+
+			body := `{"recipient":"bob","idempotency_key":"k1"}`
+			if tt.amount != "" {
+				body = `{"recipient":"bob","idempotency_key":"k1","amount":` + tt.amount + `}`
+			}
+			r := withUser(t, httptest.NewRequest(http.MethodPost, "/api/user/balance/transfer", strings.NewReader(body)), 1)
+			w := httptest.NewRecorder()
+			h.Transfer(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantCode != "" {
+				var p problem.Problem
+				if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+					t.Fatal(err)
+				}
+				if len(p.Errors) != 1 || p.Errors[0].Field != "amount" || p.Errors[0].Code != tt.wantCode {
+					t.Fatalf("errors = %+v, want amount %s", p.Errors, tt.wantCode)
+				}
+				return
+			}
+			if len(store.transfers) != 1 || store.transfers[0].Amount != tt.wantAmount {
+				t.Fatalf("transfers = %+v, want one of %v", store.transfers, tt.wantAmount)
+			}
+		})
+	}
+}
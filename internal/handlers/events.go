@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+
+	"golang.org/x/net/websocket"
+)
+
+const eventBatchSize = 100
+
+type EventHandler struct {
+	storage   storage.Storage
+	broker    *services.EventBroker
+	heartbeat time.Duration
+}
+
+func NewEventHandler(storage storage.Storage, broker *services.EventBroker, heartbeat time.Duration) *EventHandler {
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
+	}
+	return &EventHandler{storage: storage, broker: broker, heartbeat: heartbeat}
+}
+
+// Stream sends the user's order and balance events as Server-Sent Events.
+// Clients resume after a disconnect with the Last-Event-ID header, or the
+// last_event_id query parameter where they cannot set headers; without either
+// only new events are sent.
+func (h *EventHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	cursor, ok := h.cursor(w, r, userID, lastID)
+	if !ok {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	h.follow(r.Context(), userID, cursor,
+		func(events []models.Event) error {
+			for _, event := range events {
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+			}
+			return rc.Flush()
+		},
+		func() error {
+			fmt.Fprint(w, ": ping\n\n")
+			return rc.Flush()
+		},
+	)
+}
+
+type eventMessage struct {
+	ID   int64           `json:"id,omitempty"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// WebSocket sends the same events as Stream over a WebSocket, one JSON text
+// message per event, and a message of type ping as heartbeat. Clients resume
+// with the last_event_id query parameter. Messages from the client are
+// ignored.
+func (h *EventHandler) WebSocket(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+	cursor, ok := h.cursor(w, r, userID, r.URL.Query().Get("last_event_id"))
+	if !ok {
+		return
+	}
+
+	server := websocket.Server{
+		// The CSRF middleware has checked the origin of cookie-authenticated
+		// upgrades already; other clients need not send one.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+
+			go func() {
+				defer cancel()
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			send := func(msg eventMessage) error {
+				ws.SetWriteDeadline(time.Now().Add(h.heartbeat))
+				return websocket.JSON.Send(ws, msg)
+			}
+			h.follow(ctx, userID, cursor,
+				func(events []models.Event) error {
+					for _, event := range events {
+						if err := send(eventMessage{ID: event.ID, Type: event.Type, Data: event.Data}); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				func() error { return send(eventMessage{Type: "ping"}) },
+			)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// cursor returns the ID after which events are sent: the one the client
+// resumes from, or the user's latest one.
+func (h *EventHandler) cursor(w http.ResponseWriter, r *http.Request, userID int, lastID string) (int64, bool) {
+	if lastID != "" {
+		cursor, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || cursor < 0 {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid Last-Event-ID")
+			return 0, false
+		}
+		return cursor, true
+	}
+	cursor, err := h.storage.GetLastEventID(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to open event stream")
+		return 0, false
+	}
+	return cursor, true
+}
+
+// follow passes the user's events after cursor to send until ctx is done or
+// sending fails, and calls ping when there has been nothing to send for a
+// while.
+func (h *EventHandler) follow(ctx context.Context, userID int, cursor int64, send func([]models.Event) error, ping func() error) {
+	// Subscribe before the first read so that no event slips in between.
+	wake, unsubscribe := h.broker.Subscribe(userID)
+	defer unsubscribe()
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		for {
+			events, err := h.storage.GetEvents(ctx, userID, cursor, eventBatchSize)
+			if err != nil {
+				return
+			}
+			if len(events) > 0 {
+				if err := send(events); err != nil {
+					return
+				}
+				cursor = events[len(events)-1].ID
+			}
+			if len(events) < eventBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			// The heartbeat also catches up on events whose notification was lost.
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+
+	"golang.org/x/net/websocket"
+)
+
+type eventStorage struct {
+	storage.Storage
+	events []models.Event
+}
+
+func (s *eventStorage) GetEvents(_ context.Context, _ int, afterID int64, limit int) ([]models.Event, error) {
+	var events []models.Event
+	for _, event := range s.events {
+		if event.ID > afterID && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (s *eventStorage) GetLastEventID(context.Context, int) (int64, error) {
+	return s.events[len(s.events)-1].ID, nil
+}
+
+func TestEventWebSocket(t *testing.T) {
+	store := &eventStorage{events: []models.Event{
+		{ID: 1, Type: services.EventBalanceUpdated, Data: json.RawMessage(`{"current":1}`)},
+		{ID: 2, Type: services.EventBalanceUpdated, Data: json.RawMessage(`{"current":2}`)},
+		{ID: 3, Type: services.EventBalanceUpdated, Data: json.RawMessage(`{"current":3}`)},
+	}}
+	h := NewEventHandler(store, services.NewEventBroker(store, nil), 50*time.Millisecond)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.WebSocket(w, withUser(t, r, 1))
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int64
+	}{
+		{name: "resume", query: "?last_event_id=1", want: []int64{2, 3, 0}},
+		{name: "from the start", query: "?last_event_id=0", want: []int64{1, 2, 3, 0}},
+		{name: "only new events", want: []int64{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := websocket.Dial(url+tt.query, "", srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			for _, id := range tt.want {
+				var msg eventMessage
+				if err := websocket.JSON.Receive(ws, &msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.ID != id {
+					t.Fatalf("got event %d, want %d", msg.ID, id)
+				}
+				if id == 0 && msg.Type != "ping" {
+					t.Fatalf("got %q, want ping", msg.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestEventWebSocketInvalidCursor(t *testing.T) {
+	store := &eventStorage{}
+	h := NewEventHandler(store, services.NewEventBroker(store, nil), time.Second)
+
+	w := httptest.NewRecorder()
+	h.WebSocket(w, withUser(t, httptest.NewRequest(http.MethodGet, "/api/user/events/ws?last_event_id=-1", nil), 1))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
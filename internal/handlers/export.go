@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// csvFlushRows is how many CSV rows are buffered before they are flushed to
+// the client.
+const csvFlushRows = 500
+
+// ExportHandler serves order and withdrawal statements as CSV or XLSX. Rows
+// are streamed from the database, so the size of a history does not matter.
+// CSV rows go straight to the client. An XLSX workbook can only be zipped once
+// all rows are known, so excelize keeps them in a temporary file on disk until
+// then; xlsx limits how many of those exist at once.
+type ExportHandler struct {
+	storage storage.Storage
+	xlsx    chan struct{}
+}
+
+func NewExportHandler(storage storage.Storage, maxXLSX int) *ExportHandler {
+	if maxXLSX <= 0 {
+		maxXLSX = 1
+	}
+	return &ExportHandler{storage: storage, xlsx: make(chan struct{}, maxXLSX)}
+}
+
+func (h *ExportHandler) ExportOrders(w http.ResponseWriter, r *http.Request) {
+	userID, format, from, to, ok := exportParams(w, r)
+	if !ok {
+		return
+	}
+	h.export(w, r, userID, format, "orders", []string{"Number", "Status", "Accrual", "Uploaded at"},
+		func(table tableWriter) error {
+			return h.storage.StreamOrders(r.Context(), userID, from, to, func(order models.Order) error {
+				return table.WriteRow(order.Number, order.Status, order.Accrual, order.UploadedAt)
+			})
+		})
+}
+
+func (h *ExportHandler) ExportWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userID, format, from, to, ok := exportParams(w, r)
+	if !ok {
+		return
+	}
+	h.export(w, r, userID, format, "withdrawals", []string{"Order", "Sum", "Processed at"},
+		func(table tableWriter) error {
+			return h.storage.StreamWithdrawals(r.Context(), userID, from, to, func(wd models.Withdrawal) error {
+				return table.WriteRow(wd.Order, wd.Sum, wd.ProcessedAt)
+			})
+		})
+}
+
+// export writes the table filled by rows. Errors before the first byte of the
+// file has been sent are answered with a problem response; later ones can
+// only cut the download short.
+func (h *ExportHandler) export(w http.ResponseWriter, r *http.Request, userID int, format, name string, header []string, rows func(tableWriter) error) {
+	if format == "xlsx" {
+		select {
+		case h.xlsx <- struct{}{}:
+			defer func() { <-h.xlsx }()
+		default:
+			w.Header().Set("Retry-After", "10")
+			problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeExportBusy, "Too many XLSX exports in progress")
+			return
+		}
+	}
+
+	ew := &exportWriter{ResponseWriter: w}
+	table, err := newTableWriter(ew, format, name, header)
+	if err == nil {
+		err = finishTable(table, rows(table))
+	}
+	if err != nil {
+		log.Printf("Failed to export %s of user %d: %v", name, userID, err)
+		if !ew.written {
+			w.Header().Del("Content-Disposition")
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to export "+name)
+		}
+	}
+}
+
+// exportWriter records whether anything has been sent to the client.
+type exportWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *exportWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *exportWriter) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		w.written = true
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *exportWriter) Flush() {
+	if !w.written {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// exportParams reads the user and the format, from and to query parameters.
+// On invalid values it writes the error response and returns false.
+func exportParams(w http.ResponseWriter, r *http.Request) (userID int, format string, from, to time.Time, ok bool) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return 0, "", from, to, false
+	}
+
+	var errs []problem.FieldError
+	format = r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "xlsx":
+	default:
+		errs = append(errs, problem.FieldError{Field: "format", Code: "unsupported", Message: "Format must be csv or xlsx"})
+	}
+
+	from, to, dateErrs := dateRangeParams(r)
+	errs = append(errs, dateErrs...)
+
+	if len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return 0, "", from, to, false
+	}
+	return userID, format, from, to, true
+}
+
+// dateRangeParams reads the from and to query parameters. Dates are either
+// RFC 3339 timestamps or calendar days; a day given as "to" is included.
+func dateRangeParams(r *http.Request) (from, to time.Time, errs []problem.FieldError) {
+	from, fromErr := parseDateParam(r.URL.Query().Get("from"), false)
+	if fromErr != nil {
+		errs = append(errs, problem.FieldError{Field: "from", Code: "invalid_date", Message: "From must be a date or an RFC 3339 timestamp"})
+	}
+	to, toErr := parseDateParam(r.URL.Query().Get("to"), true)
+	if toErr != nil {
+		errs = append(errs, problem.FieldError{Field: "to", Code: "invalid_date", Message: "To must be a date or an RFC 3339 timestamp"})
+	}
+	if fromErr == nil && toErr == nil && !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		errs = append(errs, problem.FieldError{Field: "to", Code: "before_from", Message: "To must be after from"})
+	}
+	return from, to, errs
+}
+
+func parseDateParam(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+type tableWriter interface {
+	WriteRow(values ...interface{}) error
+	// Close completes the file.
+	Close() error
+	// Abort releases the writer without completing the file.
+	Abort()
+}
+
+// finishTable completes the table unless writing the rows failed. The status
+// has usually been sent by then, so on errors the client can only notice the
+// truncated file.
+func finishTable(table tableWriter, err error) error {
+	if err != nil {
+		table.Abort()
+		return err
+	}
+	return table.Close()
+}
+
+// newTableWriter sets the response headers for a download of the given format
+// and writes the header row.
+func newTableWriter(w http.ResponseWriter, format, name string, header []string) (tableWriter, error) {
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().UTC().Format("20060102"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	var table tableWriter
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		f := excelize.NewFile()
+		sw, err := f.NewStreamWriter("Sheet1")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		table = &xlsxTable{w: w, file: f, stream: sw}
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		table = &csvTable{w: w, csv: csv.NewWriter(w)}
+	}
+
+	values := make([]interface{}, len(header))
+	for i, v := range header {
+		values[i] = v
+	}
+	if err := table.WriteRow(values...); err != nil {
+		table.Abort()
+		return nil, err
+	}
+	return table, nil
+}
+
+type csvTable struct {
+	w    http.ResponseWriter
+	csv  *csv.Writer
+	rows int
+}
+
+func (t *csvTable) WriteRow(values ...interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			record[i] = v
+		case float64:
+			record[i] = utils.FormatAmount(v)
+		case time.Time:
+			record[i] = v.UTC().Format(time.RFC3339)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	if err := t.csv.Write(record); err != nil {
+		return err
+	}
+
+	t.rows++
+	if t.rows%csvFlushRows == 0 {
+		return t.flush()
+	}
+	return nil
+}
+
+func (t *csvTable) flush() error {
+	t.csv.Flush()
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return t.csv.Error()
+}
+
+func (t *csvTable) Close() error {
+	return t.flush()
+}
+
+func (t *csvTable) Abort() {}
+
+// xlsxTable streams rows into the sheet, which excelize moves to a temporary
+// file once it grows; the workbook is zipped straight into the response on
+// Close.
+type xlsxTable struct {
+	w      http.ResponseWriter
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	rows   int
+}
+
+func (t *xlsxTable) WriteRow(values ...interface{}) error {
+	for i, v := range values {
+		if tm, ok := v.(time.Time); ok {
+			values[i] = tm.UTC()
+		}
+	}
+	t.rows++
+	cell, err := excelize.CoordinatesToCellName(1, t.rows)
+	if err != nil {
+		return err
+	}
+	return t.stream.SetRow(cell, values)
+}
+
+func (t *xlsxTable) Close() error {
+	defer t.file.Close()
+	if err := t.stream.Flush(); err != nil {
+		return err
+	}
+	return t.file.Write(t.w)
+}
+
+func (t *xlsxTable) Abort() {
+	t.file.Close()
+}
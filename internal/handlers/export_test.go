@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/storage"
+)
+
+// exportStorage streams the given number of orders, then fails with err.
+type exportStorage struct {
+	storage.Storage
+	rows int
+	err  error
+}
+
+func (s *exportStorage) StreamOrders(_ context.Context, _ int, _, _ time.Time, fn func(models.Order) error) error {
+	for i := 0; i < s.rows; i++ {
+		if err := fn(models.Order{Number: fmt.Sprint(i), Status: "NEW", UploadedAt: time.Now()}); err != nil {
+			return err
+		}
+	}
+	return s.err
+}
+
+func TestExportOrders(t *testing.T) {
+	failure := errors.New("connection reset")
+	tests := []struct {
+		name        string
+		format      string
+		rows        int
+		err         error
+		wantStatus  int
+		wantProblem bool
+	}{
+		{name: "csv", format: "csv", rows: 3, wantStatus: http.StatusOK},
+		{name: "xlsx", format: "xlsx", rows: 3, wantStatus: http.StatusOK},
+		{name: "csv error before the first row is sent", format: "csv", rows: 3, err: failure, wantStatus: http.StatusInternalServerError, wantProblem: true},
+		{name: "xlsx error", format: "xlsx", rows: 3, err: failure, wantStatus: http.StatusInternalServerError, wantProblem: true},
+		{name: "csv error after rows were sent", format: "csv", rows: csvFlushRows + 1, err: failure, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewExportHandler(&exportStorage{rows: tt.rows, err: tt.err}, 1)
+			w := httptest.NewRecorder()
+			h.ExportOrders(w, withUser(t, httptest.NewRequest(http.MethodGet, "/api/user/orders/export?format="+tt.format, nil), 1))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			isProblem := w.Header().Get("Content-Type") == problem.ContentType
+			if isProblem != tt.wantProblem {
+				t.Fatalf("Content-Type = %s", w.Header().Get("Content-Type"))
+			}
+			if isProblem && w.Header().Get("Content-Disposition") != "" {
+				t.Fatal("problem response sent as attachment")
+			}
+			if !isProblem && tt.format == "csv" && !strings.HasPrefix(w.Body.String(), "Number,Status,Accrual,Uploaded at\n") {
+				t.Fatalf("body = %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestExportXLSXLimit(t *testing.T) {
+	h := NewExportHandler(&exportStorage{rows: 1}, 1)
+	h.xlsx <- struct{}{}
+
+	w := httptest.NewRecorder()
+	h.ExportOrders(w, withUser(t, httptest.NewRequest(http.MethodGet, "/api/user/orders/export?format=xlsx", nil), 1))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("status = %d, Retry-After = %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	w = httptest.NewRecorder()
+	h.ExportOrders(w, withUser(t, httptest.NewRequest(http.MethodGet, "/api/user/orders/export?format=csv", nil), 1))
+	if w.Code != http.StatusOK {
+		t.Fatalf("csv export while XLSX exports are busy: status = %d", w.Code)
+	}
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	md "gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+	"gophermart/internal/validation"
+)
+
+const oidcStateCookie = "oidc_state"
+
+type OIDCHandler struct {
+	storage      storage.Storage
+	provider     *services.OIDCProvider
+	postLoginURL string
+}
+
+func NewOIDCHandler(storage storage.Storage, provider *services.OIDCProvider, postLoginURL string) *OIDCHandler {
+	return &OIDCHandler{
+		storage:      storage,
+		provider:     provider,
+		postLoginURL: postLoginURL,
+	}
+}
+
+// Login redirects to the identity provider. The state, nonce and PKCE verifier
+// travel in a signed cookie, so any replica can handle the callback. A user who
+// is already logged in gets the external identity linked to their account.
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	linkUserID, _, err := md.AuthenticatedUserID(r, h.storage)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to start login")
+		return
+	}
+
+	state, err1 := utils.RandomToken(16)
+	nonce, err2 := utils.RandomToken(16)
+	verifier, err3 := utils.RandomToken(32)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to start login")
+		return
+	}
+
+	authURL, err := h.provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to build OIDC authorization URL: %v", err)
+		problem.Error(w, r, http.StatusBadGateway, problem.CodeUpstreamUnavailable, "Identity provider unavailable")
+		return
+	}
+
+	stateToken, err := md.GeneratePurposeToken("oidc", map[string]interface{}{
+		"state":        state,
+		"nonce":        nonce,
+		"verifier":     verifier,
+		"link_user_id": linkUserID,
+	}, 10*time.Minute)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to start login")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateToken,
+		Path:     "/api/user/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Missing login state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/user/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	claims, err := md.ParsePurposeToken("oidc", cookie.Value)
+	if err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid or expired login state")
+		return
+	}
+	state, _ := claims["state"].(string)
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+	linkUserID, _ := claims["link_user_id"].(float64)
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid login state")
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Login failed: "+e)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Missing authorization code")
+		return
+	}
+
+	identity, err := h.provider.Exchange(r.Context(), code, verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Login failed")
+		return
+	}
+
+	user, err := h.resolveUser(r, identity, int(linkUserID))
+	if err != nil {
+		if errors.Is(err, storage.ErrIdentityLinked) {
+			problem.Error(w, r, http.StatusConflict, problem.CodeIdentityLinked, "Identity is linked to another account")
+		} else {
+			log.Printf("Failed to resolve OIDC user: %v", err)
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to authenticate")
+		}
+		return
+	}
+
+	// An address the provider has verified counts as verified here, unless
+	// the user has set a different one.
+	if identity.Email != "" && identity.EmailVerified {
+		if err := h.storage.SetVerifiedEmail(r.Context(), user.ID, identity.Email); err != nil {
+			log.Printf("Failed to store verified email of user %d: %v", user.ID, err)
+		}
+	}
+
+	if user.TwoFactorEnabled {
+		mfaToken, err := md.GenerateMFAToken(user)
+		if err != nil {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
+			return
+		}
+		render.Write(w, r, http.StatusAccepted, map[string]string{"mfa_token": mfaToken})
+		return
+	}
+
+	if err := startSession(w, r, h.storage, user); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
+		return
+	}
+	http.Redirect(w, r, h.postLoginURL, http.StatusFound)
+}
+
+// resolveUser finds the user linked to the identity, links it to the user who
+// started the login, or registers a new user.
+func (h *OIDCHandler) resolveUser(r *http.Request, identity *services.OIDCIdentity, linkUserID int) (*models.User, error) {
+	ctx := r.Context()
+
+	user, err := h.storage.GetUserByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err == nil {
+		if linkUserID != 0 && user.ID != linkUserID {
+			return nil, storage.ErrIdentityLinked
+		}
+		return user, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	if linkUserID != 0 {
+		if err := h.storage.LinkIdentity(ctx, linkUserID, identity.Issuer, identity.Subject); err != nil {
+			return nil, err
+		}
+		return h.storage.GetUserByID(ctx, linkUserID)
+	}
+
+	base := oidcLogin(identity)
+	for attempt := 0; attempt < 5; attempt++ {
+		login := base
+		if attempt > 0 {
+			suffix, err := utils.RandomToken(3)
+			if err != nil {
+				return nil, err
+			}
+			login = base + "-" + strings.ToLower(suffix)
+		}
+
+		// Users created here have no password until they set one via reset.
+		user := &models.User{Login: login, Password: "!"}
+		err := h.storage.CreateUserWithIdentity(ctx, user, identity.Issuer, identity.Subject)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, storage.ErrUserExists) {
+			return nil, err
+		}
+	}
+	return nil, errors.New("no free login for external identity")
+}
+
+func oidcLogin(identity *services.OIDCIdentity) string {
+	for _, candidate := range []string{identity.PreferredUsername, identity.Email} {
+		if login := validation.NormalizeLogin(candidate); login != "" {
+			return login
+		}
+	}
+	subject := identity.Subject
+	if len(subject) > 12 {
+		subject = subject[:12]
+	}
+	return "oidc-" + subject
+}
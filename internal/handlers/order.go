@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -10,80 +11,94 @@ import (
 
 	"gophermart/internal/middleware"
 	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
 	"gophermart/internal/storage"
 	"gophermart/internal/utils"
 )
 
 type OrderHandler struct {
 	storage storage.Storage
+	orders  *services.OrderService
 }
 
-func NewOrderHandler(storage storage.Storage) *OrderHandler {
-	return &OrderHandler{storage: storage}
+func NewOrderHandler(storage storage.Storage, orders *services.OrderService) *OrderHandler {
+	return &OrderHandler{storage: storage, orders: orders}
 }
 
+// UploadOrder accepts the order number as plain text or as a JSON object
+// {"number": "..."}.
 func (h *OrderHandler) UploadOrder(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+	var orderNumber string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Number string `json:"number"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+			return
+		}
+		orderNumber = strings.TrimSpace(req.Number)
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read request body")
+			return
+		}
+		orderNumber = strings.TrimSpace(string(body))
 	}
 
-	orderNumber := strings.TrimSpace(string(body))
 	if orderNumber == "" {
-		http.Error(w, "Empty order number", http.StatusBadRequest)
-		return
-	}
-
-	if !utils.IsValidLuhn(orderNumber) {
-		http.Error(w, "Invalid order number format", http.StatusUnprocessableEntity)
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Empty order number")
 		return
 	}
 
 	userID, err := middleware.GetUserIDFromToken(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
-	existingOrder, err := h.storage.GetOrderByNumber(r.Context(), orderNumber)
-	if err == nil {
-		if existingOrder.UserID == userID {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			http.Error(w, "Order already uploaded by another user", http.StatusConflict)
-		}
-		return
-	} else if !errors.Is(err, storage.ErrOrderNotFound) {
-		http.Error(w, "Failed to check order", http.StatusInternalServerError)
+	_, created, ok := h.upload(w, r, userID, orderNumber)
+	if !ok {
 		return
 	}
-
-	newOrder := models.Order{
-		Number:     orderNumber,
-		Status:     "NEW",
-		UploadedAt: time.Now(),
-		UserID:     userID,
+	if created {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
 	}
+}
 
-	if err := h.storage.CreateOrder(r.Context(), &newOrder); err != nil {
-		http.Error(w, "Failed to save order", http.StatusInternalServerError)
-		return
+// upload stores the order and reports whether it is new. On failure it writes
+// the error response and returns false.
+func (h *OrderHandler) upload(w http.ResponseWriter, r *http.Request, userID int, number string) (*models.Order, bool, bool) {
+	order, created, err := h.orders.Upload(r.Context(), userID, number)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidOrderNumber):
+			problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidOrderNumber, "Invalid order number format")
+		case errors.Is(err, services.ErrOrderOwnedByOtherUser):
+			problem.Error(w, r, http.StatusConflict, problem.CodeOrderOwnedByOtherUser, "Order already uploaded by another user")
+		default:
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to save order")
+		}
+		return nil, false, false
 	}
-
-	w.WriteHeader(http.StatusAccepted)
+	return order, created, true
 }
 
 func (h *OrderHandler) GetOrders(w http.ResponseWriter, r *http.Request) {
 	userID, err := middleware.GetUserIDFromToken(r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	orders, err := h.storage.GetOrders(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "Failed to get orders", http.StatusInternalServerError)
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get orders")
 		return
 	}
 
@@ -92,6 +107,114 @@ func (h *OrderHandler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	render.Write(w, r, http.StatusOK, orders)
+}
+
+const maxBatchOrders = 1000
+
+const (
+	batchAccepted         = "accepted"
+	batchAlreadyYours     = "already_yours"
+	batchOwnedByOtherUser = "owned_by_other_user"
+	batchInvalid          = "invalid"
+)
+
+type batchResult struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
+}
+
+// UploadOrders accepts many order numbers at once, as a JSON array of strings
+// or as text with one number per line. Valid new numbers are stored in one
+// transaction and the outcome is reported for every item in request order.
+func (h *OrderHandler) UploadOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var numbers []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&numbers); err != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+			return
+		}
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read request body")
+			return
+		}
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+	}
+
+	if len(numbers) == 0 {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "No order numbers given")
+		return
+	}
+	if len(numbers) > maxBatchOrders {
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.CodeBodyTooLarge,
+			fmt.Sprintf("At most %d order numbers per request", maxBatchOrders))
+		return
+	}
+
+	results := make([]batchResult, len(numbers))
+	// A number repeated in the batch gets the result of its first occurrence.
+	first := make(map[string]int)
+	repeats := make(map[int]int)
+	var orders []models.Order
+	now := time.Now()
+	for i, number := range numbers {
+		number = strings.TrimSpace(number)
+		results[i] = batchResult{Number: number}
+		if j, ok := first[number]; ok {
+			repeats[i] = j
+			continue
+		}
+		first[number] = i
+		if number == "" || !utils.IsValidLuhn(number) {
+			results[i].Status = batchInvalid
+			continue
+		}
+		orders = append(orders, models.Order{
+			Number:     number,
+			Status:     "NEW",
+			UploadedAt: now,
+			UserID:     userID,
+		})
+	}
+
+	existing, err := h.storage.CreateOrders(r.Context(), orders)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to save orders")
+		return
+	}
+
+	summary := make(map[string]int)
+	for i := range results {
+		if j, ok := repeats[i]; ok {
+			results[i].Status = results[j].Status
+		} else if results[i].Status == "" {
+			owner, ok := existing[results[i].Number]
+			switch {
+			case !ok:
+				results[i].Status = batchAccepted
+			case owner == userID:
+				results[i].Status = batchAlreadyYours
+			default:
+				results[i].Status = batchOwnedByOtherUser
+			}
+		}
+		summary[results[i].Status]++
+	}
+
+	render.Write(w, r, http.StatusOK, struct {
+		Summary map[string]int `json:"summary"`
+		Results []batchResult  `json:"results"`
+	}{summary, results})
 }
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+)
+
+type batchStorage struct {
+	storage.Storage
+	owners map[string]int
+}
+
+func (s *batchStorage) CreateOrders(_ context.Context, orders []models.Order) (map[string]int, error) {
+	existing := make(map[string]int)
+	for _, order := range orders {
+		if owner, ok := s.owners[order.Number]; ok {
+			existing[order.Number] = owner
+		} else {
+			s.owners[order.Number] = order.UserID
+		}
+	}
+	return existing, nil
+}
+
+func TestUploadOrders(t *testing.T) {
+	// 12345678903 and 79927398713 pass the Luhn check, 12345678900 does not.
+	tests := []struct {
+		name   string
+		body   string
+		owners map[string]int
+		want   []string
+	}{
+		{
+			name: "new numbers",
+			body: "12345678903\n79927398713",
+			want: []string{batchAccepted, batchAccepted},
+		},
+		{
+			name: "repeated new number",
+			body: "12345678903\n12345678903",
+			want: []string{batchAccepted, batchAccepted},
+		},
+		{
+			name:   "repeated number of another user",
+			body:   "79927398713\n12345678903\n79927398713",
+			owners: map[string]int{"79927398713": 2},
+			want:   []string{batchOwnedByOtherUser, batchAccepted, batchOwnedByOtherUser},
+		},
+		{
+			name:   "repeated own number",
+			body:   "12345678903\n12345678903",
+			owners: map[string]int{"12345678903": 1},
+			want:   []string{batchAlreadyYours, batchAlreadyYours},
+		},
+		{
+			name: "repeated invalid number",
+			body: "12345678900\n12345678900",
+			want: []string{batchInvalid, batchInvalid},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owners := make(map[string]int)
+			for number, owner := range tt.owners {
+				owners[number] = owner
+			}
+			store := &batchStorage{owners: owners}
+			h := NewOrderHandler(store, services.NewOrderService(store))
+
+			r := httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			h.UploadOrders(w, withUser(t, r, 1))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var resp struct {
+				Results []batchResult `json:"results"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Results) != len(tt.want) {
+				t.Fatalf("got %d results, want %d", len(resp.Results), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if resp.Results[i].Status != want {
+					t.Errorf("result %d = %s, want %s", i, resp.Results[i].Status, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadOrdersTooMany(t *testing.T) {
+	store := &batchStorage{owners: make(map[string]int)}
+	h := NewOrderHandler(store, services.NewOrderService(store))
+
+	body := strings.Repeat("79927398713\n", maxBatchOrders+1)
+	r := httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	h.UploadOrders(w, withUser(t, r, 1))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", w.Code)
+	}
+	var p problem.Problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Code != problem.CodeBodyTooLarge {
+		t.Fatalf("code = %s, want %s", p.Code, problem.CodeBodyTooLarge)
+	}
+	if len(store.owners) != 0 {
+		t.Fatalf("stored %d orders", len(store.owners))
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+	"gophermart/internal/validation"
+)
+
+type PasswordHandler struct {
+	storage  storage.Storage
+	auth     *services.AuthService
+	notifier services.Notifier
+	policy   *validation.Policy
+	resetTTL time.Duration
+}
+
+func NewPasswordHandler(storage storage.Storage, auth *services.AuthService, notifier services.Notifier, policy *validation.Policy, resetTTL time.Duration) *PasswordHandler {
+	return &PasswordHandler{
+		storage:  storage,
+		auth:     auth,
+		notifier: notifier,
+		policy:   policy,
+		resetTTL: resetTTL,
+	}
+}
+
+func (h *PasswordHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Current and new password are required")
+		return
+	}
+
+	user, err := h.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to change password")
+		return
+	}
+
+	if err := h.auth.CheckPassword(r.Context(), user, req.CurrentPassword, middleware.ClientIP(r)); err != nil {
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			problem.Error(w, r, http.StatusForbidden, problem.CodeInvalidPassword, "Invalid current password")
+		} else {
+			loginFailed(w, r, err)
+		}
+		return
+	}
+
+	if errs := h.policy.ValidatePassword(req.NewPassword, user.Login); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to change password")
+		return
+	}
+
+	user.TokenVersion, err = h.storage.UpdatePassword(r.Context(), userID, hashedPassword)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to change password")
+		return
+	}
+
+	// Other sessions are signed out by the version bump, the current one
+	// gets a fresh token.
+	if err := startSession(w, r, h.storage, user); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to generate token")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// RequestReset always answers 202 so the endpoint cannot be used to find out
+// which logins exist. Failures are logged instead of reported.
+func (h *PasswordHandler) RequestReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	if req.Login == "" {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Login is required")
+		return
+	}
+
+	if err := h.sendReset(r.Context(), validation.NormalizeLogin(req.Login)); err != nil {
+		log.Printf("Failed to request password reset: %v", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendReset creates a reset token for the user with the login and sends it to
+// their verified email address. Unknown logins and users without a verified
+// address are not an error; the latter cannot reset their password.
+func (h *PasswordHandler) sendReset(ctx context.Context, login string) error {
+	user, err := h.storage.GetUserByLogin(ctx, login)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	profile, err := h.storage.GetProfile(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if profile.Email == "" || !profile.EmailVerified {
+		return nil
+	}
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(h.resetTTL)
+	if err := h.storage.CreatePasswordReset(ctx, user.ID, utils.HashToken(token), expiresAt); err != nil {
+		return err
+	}
+
+	msg := &models.OutboxMessage{
+		UserID:    user.ID,
+		Recipient: profile.Email,
+		Subject:   "Password reset",
+		Body: fmt.Sprintf(
+			"Use this token to reset your password: %s\nThe token expires at %s.",
+			token, expiresAt.Format(time.RFC3339),
+		),
+		CreatedAt: time.Now(),
+	}
+	if err := h.notifier.Notify(ctx, msg); err != nil {
+		return fmt.Errorf("deliver password reset for user %d: %w", user.ID, err)
+	}
+	return nil
+}
+
+func (h *PasswordHandler) ConfirmReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	if req.Token == "" || req.NewPassword == "" {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Token and new password are required")
+		return
+	}
+
+	if errs := h.policy.ValidatePassword(req.NewPassword, ""); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to reset password")
+		return
+	}
+
+	if _, err := h.storage.ResetPassword(r.Context(), utils.HashToken(req.Token), hashedPassword); err != nil {
+		if errors.Is(err, storage.ErrResetTokenInvalid) {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidResetToken, "Invalid or expired reset token")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to reset password")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
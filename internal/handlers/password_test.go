@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+)
+
+type resetStorage struct {
+	storage.Storage
+	profile models.Profile
+	resets  int
+}
+
+func (s *resetStorage) GetUserByLogin(_ context.Context, login string) (*models.User, error) {
+	if login != "alice" {
+		return nil, storage.ErrNotFound
+	}
+	return &models.User{ID: 1, Login: "alice"}, nil
+}
+
+func (s *resetStorage) GetProfile(context.Context, int) (*models.Profile, error) {
+	profile := s.profile
+	return &profile, nil
+}
+
+func (s *resetStorage) CreatePasswordReset(context.Context, int, string, time.Time) error {
+	s.resets++
+	return nil
+}
+
+func TestRequestReset(t *testing.T) {
+	tests := []struct {
+		name          string
+		login         string
+		profile       models.Profile
+		wantRecipient string
+	}{
+		{name: "verified email", login: "alice", profile: models.Profile{Email: "alice@example.com", EmailVerified: true}, wantRecipient: "alice@example.com"},
+		{name: "unverified email", login: "alice", profile: models.Profile{Email: "alice@example.com"}},
+		{name: "no email", login: "alice"},
+		{name: "unknown login", login: "bob", profile: models.Profile{Email: "bob@example.com", EmailVerified: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &resetStorage{profile: tt.profile}
+			notifier := &recordingNotifier{}
+			h := NewPasswordHandler(store, nil, notifier, nil, time.Hour)
+
+			w := httptest.NewRecorder()
+			h.RequestReset(w, httptest.NewRequest(http.MethodPost, "/api/user/password/reset", strings.NewReader(`{"login":"`+tt.login+`"}`)))
+
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want 202", w.Code)
+			}
+			if tt.wantRecipient == "" {
+				if len(notifier.messages) != 0 || store.resets != 0 {
+					t.Fatalf("sent %d messages, created %d tokens", len(notifier.messages), store.resets)
+				}
+				return
+			}
+			if len(notifier.messages) != 1 || notifier.messages[0].Recipient != tt.wantRecipient {
+				t.Fatalf("messages = %+v, want one to %s", notifier.messages, tt.wantRecipient)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+	"gophermart/internal/validation"
+)
+
+type ProfileHandler struct {
+	storage   storage.Storage
+	notifier  services.Notifier
+	verifyTTL time.Duration
+}
+
+func NewProfileHandler(storage storage.Storage, notifier services.Notifier, verifyTTL time.Duration) *ProfileHandler {
+	return &ProfileHandler{storage: storage, notifier: notifier, verifyTTL: verifyTTL}
+}
+
+func (h *ProfileHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	profile, err := h.storage.GetProfile(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get profile")
+		}
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, profile)
+}
+
+// UpdateProfile changes only the fields present in the request. An empty email
+// or phone clears it.
+func (h *ProfileHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		DisplayName   *string `json:"display_name"`
+		Email         *string `json:"email"`
+		Phone         *string `json:"phone"`
+		Locale        *string `json:"locale"`
+		Notifications *struct {
+			OrderUpdates *bool `json:"order_updates"`
+			Withdrawals  *bool `json:"withdrawals"`
+			Marketing    *bool `json:"marketing"`
+		} `json:"notifications"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	profile, err := h.storage.GetProfile(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get profile")
+		}
+		return
+	}
+
+	if req.DisplayName != nil {
+		profile.DisplayName = *req.DisplayName
+	}
+	if req.Email != nil {
+		profile.Email = *req.Email
+	}
+	if req.Phone != nil {
+		profile.Phone = *req.Phone
+	}
+	if req.Locale != nil {
+		profile.Locale = *req.Locale
+	}
+	if n := req.Notifications; n != nil {
+		if n.OrderUpdates != nil {
+			profile.Notifications.OrderUpdates = *n.OrderUpdates
+		}
+		if n.Withdrawals != nil {
+			profile.Notifications.Withdrawals = *n.Withdrawals
+		}
+		if n.Marketing != nil {
+			profile.Notifications.Marketing = *n.Marketing
+		}
+	}
+
+	validation.NormalizeProfile(profile)
+	if errs := validation.ValidateProfile(profile); len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	if err := h.storage.UpdateProfile(r.Context(), userID, profile); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrEmailTaken):
+			problem.Error(w, r, http.StatusConflict, problem.CodeEmailTaken, "Email is already in use")
+		case errors.Is(err, storage.ErrNotFound):
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		default:
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to update profile")
+		}
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, profile)
+}
+
+// RequestEmailVerification sends a verification token to the email address of
+// the user.
+func (h *ProfileHandler) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	profile, err := h.storage.GetProfile(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get profile")
+		}
+		return
+	}
+	if profile.Email == "" {
+		problem.Error(w, r, http.StatusConflict, problem.CodeConflict, "No email address to verify")
+		return
+	}
+	if profile.EmailVerified {
+		problem.Error(w, r, http.StatusConflict, problem.CodeConflict, "Email is already verified")
+		return
+	}
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to send verification")
+		return
+	}
+	expiresAt := time.Now().Add(h.verifyTTL)
+	if err := h.storage.CreateEmailVerification(r.Context(), userID, profile.Email, utils.HashToken(token), expiresAt); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to send verification")
+		return
+	}
+
+	msg := &models.OutboxMessage{
+		UserID:    userID,
+		Recipient: profile.Email,
+		Subject:   "Verify your email address",
+		Body: fmt.Sprintf(
+			"Use this token to verify your email address: %s\nThe token expires at %s.",
+			token, expiresAt.Format(time.RFC3339),
+		),
+		CreatedAt: time.Now(),
+	}
+	if err := h.notifier.Notify(r.Context(), msg); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to send verification")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfirmEmailVerification marks the email address as verified with a token
+// sent by RequestEmailVerification. It needs no login, so the token can be
+// used from another device.
+func (h *ProfileHandler) ConfirmEmailVerification(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+	if req.Token == "" {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Token is required")
+		return
+	}
+
+	if err := h.storage.VerifyEmail(r.Context(), utils.HashToken(req.Token)); err != nil {
+		if errors.Is(err, storage.ErrVerificationTokenInvalid) {
+			problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidVerifyToken, "Invalid or expired verification token")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to verify email")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// withUser authenticates r as the user, the way the Verifier middleware does.
+func withUser(t *testing.T, r *http.Request, userID int) *http.Request {
+	t.Helper()
+	token := jwt.New()
+	if err := token.Set("user_id", float64(userID)); err != nil {
+		t.Fatal(err)
+	}
+	return r.WithContext(jwtauth.NewContext(r.Context(), token, nil))
+}
+
+type recordingNotifier struct {
+	messages []*models.OutboxMessage
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, msg *models.OutboxMessage) error {
+	n.messages = append(n.messages, msg)
+	return nil
+}
+
+type verificationStorage struct {
+	storage.Storage
+	profile      models.Profile
+	verification string
+	email        string
+}
+
+func (s *verificationStorage) GetProfile(context.Context, int) (*models.Profile, error) {
+	profile := s.profile
+	return &profile, nil
+}
+
+func (s *verificationStorage) CreateEmailVerification(_ context.Context, _ int, email, tokenHash string, _ time.Time) error {
+	s.verification, s.email = tokenHash, email
+	return nil
+}
+
+func (s *verificationStorage) VerifyEmail(_ context.Context, tokenHash string) error {
+	if tokenHash != s.verification || !strings.EqualFold(s.email, s.profile.Email) {
+		return storage.ErrVerificationTokenInvalid
+	}
+	s.profile.EmailVerified = true
+	return nil
+}
+
+func TestRequestEmailVerification(t *testing.T) {
+	tests := []struct {
+		name       string
+		profile    models.Profile
+		wantStatus int
+	}{
+		{name: "unverified", profile: models.Profile{Email: "alice@example.com"}, wantStatus: http.StatusAccepted},
+		{name: "no email", profile: models.Profile{}, wantStatus: http.StatusConflict},
+		{name: "already verified", profile: models.Profile{Email: "alice@example.com", EmailVerified: true}, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &verificationStorage{profile: tt.profile}
+			notifier := &recordingNotifier{}
+			h := NewProfileHandler(store, notifier, time.Hour)
+
+			w := httptest.NewRecorder()
+			h.RequestEmailVerification(w, withUser(t, httptest.NewRequest(http.MethodPost, "/api/user/me/email/verify", nil), 1))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusAccepted {
+				if len(notifier.messages) != 0 {
+					t.Fatal("verification sent")
+				}
+				return
+			}
+			if len(notifier.messages) != 1 || notifier.messages[0].Recipient != tt.profile.Email {
+				t.Fatalf("messages = %+v, want one to %s", notifier.messages, tt.profile.Email)
+			}
+		})
+	}
+}
+
+func TestConfirmEmailVerification(t *testing.T) {
+	store := &verificationStorage{profile: models.Profile{Email: "alice@example.com"}}
+	notifier := &recordingNotifier{}
+	h := NewProfileHandler(store, notifier, time.Hour)
+
+	w := httptest.NewRecorder()
+	h.RequestEmailVerification(w, withUser(t, httptest.NewRequest(http.MethodPost, "/api/user/me/email/verify", nil), 1))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("request status = %d", w.Code)
+	}
+	body := notifier.messages[0].Body
+	token := strings.Fields(body[strings.Index(body, ": ")+2:])[0]
+	if store.verification != utils.HashToken(token) {
+		t.Fatal("token is not stored hashed")
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "wrong token", body: `{"token":"wrong"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing token", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "token", body: `{"token":"` + token + `"}`, wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ConfirmEmailVerification(w, httptest.NewRequest(http.MethodPost, "/api/user/email/verify/confirm", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+	if !store.profile.EmailVerified {
+		t.Fatal("email not verified")
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type SessionHandler struct {
+	storage storage.Storage
+}
+
+func NewSessionHandler(storage storage.Storage) *SessionHandler {
+	return &SessionHandler{storage: storage}
+}
+
+func (h *SessionHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	sessions, err := h.storage.GetSessions(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get sessions")
+		return
+	}
+
+	if len(sessions) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	current := middleware.GetSessionIDFromToken(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	render.Write(w, r, http.StatusOK, sessions)
+}
+
+// RevokeSession signs the session out. Its token is rejected from the next
+// request on, including when the current session is revoked.
+func (h *SessionHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.storage.RevokeSession(r.Context(), userID, chi.URLParam(r, "id")); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "Session not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke session")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
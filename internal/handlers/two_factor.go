@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+)
+
+type TwoFactorHandler struct {
+	storage   storage.Storage
+	twoFactor *services.TwoFactorService
+}
+
+func NewTwoFactorHandler(storage storage.Storage, twoFactor *services.TwoFactorService) *TwoFactorHandler {
+	return &TwoFactorHandler{storage: storage, twoFactor: twoFactor}
+}
+
+func (h *TwoFactorHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := h.storage.GetUserByID(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to enroll two-factor authentication")
+		return
+	}
+
+	secret, url, err := h.twoFactor.Enroll(r.Context(), user)
+	if err != nil {
+		if errors.Is(err, storage.ErrTwoFactorEnabled) {
+			problem.Error(w, r, http.StatusConflict, problem.CodeTwoFactorEnabled, "Two-factor authentication is already enabled")
+		} else if errors.Is(err, services.ErrTwoFactorUnavailable) {
+			problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeTwoFactorUnavailable, "Two-factor authentication is not configured on this server")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to enroll two-factor authentication")
+		}
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_url": url,
+	})
+}
+
+func (h *TwoFactorHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	codes, err := h.twoFactor.Confirm(r.Context(), userID, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCode):
+			problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidTwoFactorCode, "Invalid two-factor code")
+		case errors.Is(err, services.ErrTwoFactorLocked):
+			problem.Error(w, r, http.StatusTooManyRequests, problem.CodeTwoFactorLocked, "Too many invalid two-factor codes")
+		case errors.Is(err, storage.ErrTwoFactorEnabled):
+			problem.Error(w, r, http.StatusConflict, problem.CodeTwoFactorEnabled, "Two-factor authentication is already enabled")
+		default:
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to enable two-factor authentication")
+		}
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+func (h *TwoFactorHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	if err := h.twoFactor.Disable(r.Context(), userID, req.Code); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCode):
+			problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidTwoFactorCode, "Invalid two-factor code")
+		case errors.Is(err, services.ErrTwoFactorLocked):
+			problem.Error(w, r, http.StatusTooManyRequests, problem.CodeTwoFactorLocked, "Too many invalid two-factor codes")
+		default:
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to disable two-factor authentication")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// amount is a sum of points, written in JSON and MessagePack as a decimal
+// string with two fractional digits so clients do not have to deal with floats.
+type amount float64
+
+func (a amount) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + utils.FormatAmount(float64(a)) + `"`), nil
+}
+
+func (a amount) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.EncodeString(utils.FormatAmount(float64(a)))
+}
+
+func (a *amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("amount must be a decimal string")
+	}
+	v, err := utils.ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount(v)
+	return nil
+}
+
+type orderV2 struct {
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	Accrual    amount    `json:"accrual"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+type withdrawalV2 struct {
+	Order       string    `json:"order"`
+	Sum         amount    `json:"sum"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type pagination struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Total  int `json:"total"`
+	// set while there are more items after this page
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type page[T any] struct {
+	Items      []T        `json:"items"`
+	Pagination pagination `json:"pagination"`
+}
+
+func newPage[T any](items []T, limit, offset, total int) page[T] {
+	p := page[T]{Items: items, Pagination: pagination{Limit: limit, Offset: offset, Total: total}}
+	if next := offset + len(items); len(items) > 0 && next < total {
+		p.Pagination.NextOffset = &next
+	}
+	return p
+}
+
+// V2Handler serves /api/v2. It shares storage and business rules with the v1
+// handlers, but uses decimal strings for amounts, answers empty lists with
+// 200 and paginates lists.
+type V2Handler struct {
+	storage storage.Storage
+	orders  *OrderHandler
+	balance *BalanceHandler
+}
+
+func NewV2Handler(storage storage.Storage, orders *OrderHandler, balance *BalanceHandler) *V2Handler {
+	return &V2Handler{storage: storage, orders: orders, balance: balance}
+}
+
+func (h *V2Handler) UploadOrder(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Number string `json:"number"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	number := strings.TrimSpace(req.Number)
+	if number == "" {
+		problem.Validation(w, r, []problem.FieldError{{Field: "number", Code: "required", Message: "Order number is required"}})
+		return
+	}
+	order, created, ok := h.orders.upload(w, r, userID, number)
+	if !ok {
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusAccepted
+	}
+	render.Write(w, r, status, toOrderV2(*order))
+}
+
+func (h *V2Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	orders, total, err := h.storage.GetOrdersPage(r.Context(), userID, limit, offset)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get orders")
+		return
+	}
+
+	items := make([]orderV2, len(orders))
+	for i, order := range orders {
+		items[i] = toOrderV2(order)
+	}
+	render.Write(w, r, http.StatusOK, newPage(items, limit, offset, total))
+}
+
+func (h *V2Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	balance, err := h.storage.GetBalance(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get balance")
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, struct {
+		Current   amount `json:"current"`
+		Withdrawn amount `json:"withdrawn"`
+	}{amount(balance.Current), amount(balance.Withdrawn)})
+}
+
+func (h *V2Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		Order    string `json:"order"`
+		Sum      amount `json:"sum"`
+		TOTPCode string `json:"totp_code,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	processedAt, ok := h.balance.withdraw(w, r, userID, req.Order, float64(req.Sum), req.TOTPCode)
+	if !ok {
+		return
+	}
+
+	render.Write(w, r, http.StatusCreated, withdrawalV2{
+		Order:       req.Order,
+		Sum:         req.Sum,
+		ProcessedAt: processedAt,
+	})
+}
+
+func (h *V2Handler) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	withdrawals, total, err := h.storage.GetWithdrawalsPage(r.Context(), userID, limit, offset)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get withdrawals")
+		return
+	}
+
+	items := make([]withdrawalV2, len(withdrawals))
+	for i, wd := range withdrawals {
+		items[i] = withdrawalV2{Order: wd.Order, Sum: amount(wd.Sum), ProcessedAt: wd.ProcessedAt}
+	}
+	render.Write(w, r, http.StatusOK, newPage(items, limit, offset, total))
+}
+
+func toOrderV2(order models.Order) orderV2 {
+	return orderV2{
+		Number:     order.Number,
+		Status:     order.Status,
+		Accrual:    amount(order.Accrual),
+		UploadedAt: order.UploadedAt,
+	}
+}
+
+// pageParams reads the limit and offset query parameters. On invalid values
+// it writes the error response and returns false.
+func pageParams(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	limit = defaultPageLimit
+	var errs []problem.FieldError
+	if s := r.URL.Query().Get("limit"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 || v > maxPageLimit {
+			errs = append(errs, problem.FieldError{Field: "limit", Code: "out_of_range", Message: fmt.Sprintf("Limit must be between 1 and %d", maxPageLimit)})
+		}
+		limit = v
+	}
+	if s := r.URL.Query().Get("offset"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			errs = append(errs, problem.FieldError{Field: "offset", Code: "out_of_range", Message: "Offset must not be negative"})
+		}
+		offset = v
+	}
+	if len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
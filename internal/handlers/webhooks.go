@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gophermart/internal/middleware"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/services"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	minWebhookSecret     = 16
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type WebhookHandler struct {
+	storage storage.Storage
+}
+
+func NewWebhookHandler(storage storage.Storage) *WebhookHandler {
+	return &WebhookHandler{storage: storage}
+}
+
+// CreateWebhook subscribes a URL to events. The signing secret is generated
+// unless given and is only returned in this response.
+func (h *WebhookHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request format")
+		return
+	}
+
+	var errs []problem.FieldError
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		errs = append(errs, problem.FieldError{Field: "url", Code: "invalid_url", Message: "URL must be an absolute http or https URL"})
+	}
+	if req.Secret != "" && len(req.Secret) < minWebhookSecret {
+		errs = append(errs, problem.FieldError{Field: "secret", Code: "too_short", Message: "Secret must be at least 16 characters long"})
+	}
+	if len(req.Events) == 0 {
+		errs = append(errs, problem.FieldError{Field: "events", Code: "required", Message: "At least one event is required"})
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(services.WebhookEvents, event) {
+			errs = append(errs, problem.FieldError{Field: "events", Code: "unknown_event", Message: "Unknown event " + event})
+			break
+		}
+	}
+	if len(errs) > 0 {
+		problem.Validation(w, r, errs)
+		return
+	}
+
+	if req.Secret == "" {
+		if req.Secret, err = utils.RandomToken(32); err != nil {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to create webhook")
+			return
+		}
+	}
+	slices.Sort(req.Events)
+
+	webhook := models.Webhook{
+		UserID:    userID,
+		URL:       u.String(),
+		Secret:    req.Secret,
+		Events:    slices.Compact(req.Events),
+		CreatedAt: time.Now(),
+	}
+	if err := h.storage.CreateWebhook(r.Context(), &webhook); err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to create webhook")
+		return
+	}
+
+	render.Write(w, r, http.StatusCreated, webhook)
+}
+
+func (h *WebhookHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	webhooks, err := h.storage.GetWebhooks(r.Context(), userID)
+	if err != nil {
+		problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get webhooks")
+		return
+	}
+
+	if len(webhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, webhooks)
+}
+
+func (h *WebhookHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid webhook ID")
+		return
+	}
+
+	if err := h.storage.DeleteWebhook(r.Context(), userID, id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "Webhook not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to delete webhook")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDeliveries returns the delivery log of a webhook, newest first.
+func (h *WebhookHandler) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromToken(r)
+	if err != nil {
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid webhook ID")
+		return
+	}
+
+	limit := defaultDeliveryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxDeliveryLimit {
+			problem.Validation(w, r, []problem.FieldError{{Field: "limit", Code: "out_of_range", Message: "Limit must be between 1 and 200"}})
+			return
+		}
+	}
+
+	deliveries, err := h.storage.GetWebhookDeliveries(r.Context(), userID, id, limit)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "Webhook not found")
+		} else {
+			problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to get webhook deliveries")
+		}
+		return
+	}
+
+	if len(deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	render.Write(w, r, http.StatusOK, deliveries)
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gophermart/internal/problem"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+// RequestBody reads request bodies into memory before the validator and the
+// handlers see them, decoding a gzip, deflate or zstd Content-Encoding on the
+// way. Bodies larger than maxSize bytes as sent, or than maxDecoded bytes once
+// decoded, are answered with 413, which also bounds decompression bombs.
+func RequestBody(maxSize, maxDecoded int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > maxSize {
+				problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.CodeBodyTooLarge, "Request body too large")
+				return
+			}
+
+			raw := http.MaxBytesReader(w, r.Body, maxSize)
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			body, limit := io.Reader(raw), maxSize
+			switch encoding {
+			case "", "identity":
+			case "gzip", "x-gzip":
+				zr, err := gzip.NewReader(raw)
+				if err != nil {
+					decodeFailed(w, r, err)
+					return
+				}
+				defer zr.Close()
+				body, limit = zr, maxDecoded
+			case "deflate":
+				zr, err := zlib.NewReader(raw)
+				if err != nil {
+					decodeFailed(w, r, err)
+					return
+				}
+				defer zr.Close()
+				body, limit = zr, maxDecoded
+			case "zstd":
+				zr, err := zstd.NewReader(raw, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxDecoded)))
+				if err != nil {
+					decodeFailed(w, r, err)
+					return
+				}
+				defer zr.Close()
+				body, limit = zr, maxDecoded
+			default:
+				w.Header().Set("Accept-Encoding", "gzip, deflate, zstd")
+				problem.Error(w, r, http.StatusUnsupportedMediaType, problem.CodeUnsupportedEncoding, "Unsupported content encoding")
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(body, limit+1))
+			if err == nil && int64(len(data)) > limit {
+				err = &http.MaxBytesError{Limit: limit}
+			}
+			if err != nil {
+				decodeFailed(w, r, err)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+			r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+			r.Header.Del("Content-Encoding")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func decodeFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.CodeBodyTooLarge, "Request body too large")
+		return
+	}
+	problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read request body")
+}
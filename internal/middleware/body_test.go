@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRequestBody(t *testing.T) {
+	var got string
+	handler := RequestBody(64, 256)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		body       []byte
+		encoding   string
+		chunked    bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "plain", body: []byte(`{"login":"alice"}`), wantStatus: http.StatusOK, wantBody: `{"login":"alice"}`},
+		{name: "plain at the limit", body: bytes.Repeat([]byte("a"), 64), wantStatus: http.StatusOK, wantBody: strings.Repeat("a", 64)},
+		{name: "plain too large", body: bytes.Repeat([]byte("a"), 65), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked too large", body: bytes.Repeat([]byte("a"), 65), chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "gzip", body: gzipped(t, `{"login":"alice"}`), encoding: "gzip", wantStatus: http.StatusOK, wantBody: `{"login":"alice"}`},
+		{name: "gzip decoded at the limit", body: gzipped(t, strings.Repeat("a", 256)), encoding: "gzip", wantStatus: http.StatusOK, wantBody: strings.Repeat("a", 256)},
+		{name: "gzip bomb", body: gzipped(t, strings.Repeat("a", 257)), encoding: "gzip", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "corrupt gzip", body: []byte("not gzip"), encoding: "gzip", wantStatus: http.StatusBadRequest},
+		{name: "unsupported encoding", body: []byte("data"), encoding: "br", wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			r := httptest.NewRequest(http.MethodPost, "/api/user/orders", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got != tt.wantBody {
+				t.Fatalf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
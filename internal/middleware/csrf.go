@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"gophermart/internal/problem"
+)
+
+const (
+	CSRFCookie = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// CSRF protects state-changing requests authenticated by the auth_token cookie.
+// Requests with a bearer token or an API key are not affected, since a browser
+// never adds those on its own. A cookie request passes if it echoes the
+// csrf_token cookie in the X-CSRF-Token header, or if it did not come from a
+// foreign origin according to Sec-Fetch-Site, Origin and Referer. With
+// requireToken set, requests that give no origin at all need the token too.
+// WebSocket upgrades count as state-changing, since browsers open them across
+// origins with the user's cookies.
+func CSRF(trustedOrigins []string, requireToken bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !(isUnsafeMethod(r.Method) || isUpgrade(r)) || !cookieAuthenticated(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if validCSRFToken(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+				problem.Error(w, r, http.StatusForbidden, problem.CodeCSRFFailed, "Cross-site request rejected")
+				return
+			}
+
+			origin := r.Header.Get("Origin")
+			if origin == "" || origin == "null" {
+				if ref, err := url.Parse(r.Header.Get("Referer")); err == nil && ref.Host != "" {
+					origin = ref.Scheme + "://" + ref.Host
+				}
+			}
+
+			if origin == "" {
+				if requireToken {
+					problem.Error(w, r, http.StatusForbidden, problem.CodeCSRFFailed, "Missing CSRF token")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !trustedOrigin(r, origin, trustedOrigins) {
+				problem.Error(w, r, http.StatusForbidden, problem.CodeCSRFFailed, "Cross-site request rejected")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+func isUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func cookieAuthenticated(r *http.Request) bool {
+	if apiKeyAuthenticated(r) {
+		return false
+	}
+	fromCookie, _ := r.Context().Value(cookieAuthCtxKey{}).(bool)
+	return fromCookie
+}
+
+func validCSRFToken(r *http.Request) bool {
+	header := r.Header.Get(CSRFHeader)
+	cookie, err := r.Cookie(CSRFCookie)
+	if header == "" || err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+// trustedOrigin accepts the service's own host and the configured origins.
+func trustedOrigin(r *http.Request, origin string, trusted []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(trusted, func(t string) bool {
+		return strings.EqualFold(strings.TrimRight(t, "/"), origin)
+	})
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFWebSocketUpgrade(t *testing.T) {
+	handler := CSRF(nil, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		cookie     bool
+		upgrade    bool
+		origin     string
+		wantStatus int
+	}{
+		{name: "cookie upgrade from a foreign origin", cookie: true, upgrade: true, origin: "https://evil.example", wantStatus: http.StatusForbidden},
+		{name: "cookie upgrade from the same origin", cookie: true, upgrade: true, origin: "http://example.com", wantStatus: http.StatusOK},
+		{name: "bearer upgrade from a foreign origin", upgrade: true, origin: "https://evil.example", wantStatus: http.StatusOK},
+		{name: "cookie GET from a foreign origin", cookie: true, origin: "https://evil.example", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/events/ws", nil)
+			if tt.upgrade {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+			r.Header.Set("Origin", tt.origin)
+			if tt.cookie {
+				r = r.WithContext(context.WithValue(r.Context(), cookieAuthCtxKey{}, true))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
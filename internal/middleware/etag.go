@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gophermart/internal/problem"
+	"gophermart/internal/render"
+	"gophermart/internal/storage"
+)
+
+// ETag serves conditional GETs of a user's orders and balance. The tag is the
+// user's data version, which storage bumps on every change to them, so a
+// matching If-None-Match is answered with 304 without running the handler.
+//
+// The version is read before the handler queries the data. A change in
+// between makes the response newer than its tag, which only costs the client
+// one more full response. MessagePack responses get their own tag, since they
+// are a different representation of the same data. Tags are weak, because
+// compression changes the bytes of a response but not its meaning.
+func ETag(store storage.Storage) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := GetUserIDFromToken(r)
+			if err != nil {
+				unauthorized(w, r)
+				return
+			}
+
+			version, err := store.GetDataVersion(r.Context(), userID)
+			if err != nil {
+				problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to check data version")
+				return
+			}
+
+			etag := fmt.Sprintf(`W/"%d.%d"`, userID, version)
+			if render.Negotiate(r) == render.MessagePack {
+				etag = fmt.Sprintf(`W/"%d.%d.msgpack"`, userID, version)
+			}
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Cache-Control", "private, no-cache")
+				if render.Negotiable(r) {
+					w.Header().Add("Vary", "Accept")
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			next.ServeHTTP(&etagWriter{ResponseWriter: w, etag: etag}, r)
+		})
+	}
+}
+
+// etagMatches reports whether the If-None-Match header lists the tag, using
+// the weak comparison RFC 9110 prescribes for this header.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagWriter adds the caching headers to successful responses only, so
+// errors are never revalidated against the tag.
+type etagWriter struct {
+	http.ResponseWriter
+	etag        string
+	wroteHeader bool
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status == http.StatusOK || status == http.StatusNoContent {
+			w.Header().Set("ETag", w.etag)
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
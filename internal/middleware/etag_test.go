@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gophermart/internal/storage"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   bool
+	}{
+		{name: "weak tag", header: `W/"1.5"`, etag: `W/"1.5"`, want: true},
+		{name: "strong form of a weak tag", header: `"1.5"`, etag: `W/"1.5"`, want: true},
+		{name: "one of several", header: `"1.4", W/"1.5" , "1.6"`, etag: `W/"1.5"`, want: true},
+		{name: "any", header: `*`, etag: `W/"1.5"`, want: true},
+		{name: "older version", header: `W/"1.4"`, etag: `W/"1.5"`},
+		{name: "other representation", header: `W/"1.5"`, etag: `W/"1.5.msgpack"`},
+		{name: "empty", header: ``, etag: `W/"1.5"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.header, tt.etag); got != tt.want {
+				t.Fatalf("etagMatches(%q, %q) = %v, want %v", tt.header, tt.etag, got, tt.want)
+			}
+		})
+	}
+}
+
+type versionStorage struct {
+	storage.Storage
+}
+
+func (versionStorage) GetDataVersion(context.Context, int) (int64, error) {
+	return 5, nil
+}
+
+func TestETag(t *testing.T) {
+	handler := ETag(versionStorage{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+
+	tests := []struct {
+		name        string
+		accept      string
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string
+	}{
+		{name: "JSON", wantStatus: http.StatusOK, wantETag: `W/"1.5"`},
+		{name: "MessagePack", accept: "application/msgpack", wantStatus: http.StatusOK, wantETag: `W/"1.5.msgpack"`},
+		{name: "unchanged", ifNoneMatch: `W/"1.5"`, wantStatus: http.StatusNotModified, wantETag: `W/"1.5"`},
+		{name: "changed", ifNoneMatch: `W/"1.4"`, wantStatus: http.StatusOK, wantETag: `W/"1.5"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := jwt.New()
+			token.Set("user_id", float64(1))
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			r = r.WithContext(jwtauth.NewContext(r.Context(), token, nil))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantETag || !strings.HasPrefix(got, "W/") {
+				t.Fatalf("ETag = %s, want %s", got, tt.wantETag)
+			}
+		})
+	}
+}
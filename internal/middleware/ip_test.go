@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "no proxies", remote: "203.0.113.7:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "untrusted peer", trusted: "10.0.0.0/8", remote: "203.0.113.7:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "trusted proxy", trusted: "10.0.0.0/8", remote: "10.0.0.2:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed entries before the proxy", trusted: "10.0.0.0/8", remote: "10.0.0.2:4000", forwarded: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of proxies", trusted: "10.0.0.0/8, 192.0.2.5", remote: "10.0.0.2:4000", forwarded: []string{"198.51.100.1, 192.0.2.5", "10.0.0.3"}, want: "198.51.100.1"},
+		{name: "only proxies", trusted: "10.0.0.0/8", remote: "10.0.0.2:4000", forwarded: []string{"10.0.0.4"}, want: "10.0.0.4"},
+		{name: "garbage", trusted: "10.0.0.0/8", remote: "10.0.0.2:4000", forwarded: []string{"198.51.100.1, unknown"}, want: "10.0.0.2"},
+		{name: "no header", trusted: "10.0.0.0/8", remote: "10.0.0.2:4000", want: "10.0.0.2"},
+		{name: "ipv6", trusted: "fd00::/8", remote: "[fd00::1]:4000", forwarded: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetTrustedProxies(tt.trusted); err != nil {
+				t.Fatal(err)
+			}
+			defer SetTrustedProxies("")
+
+			r := httptest.NewRequest(http.MethodPost, "/api/user/login", nil)
+			r.RemoteAddr = tt.remote
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Fatalf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	defer SetTrustedProxies("")
+	for _, s := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/8/8"} {
+		if err := SetTrustedProxies(s); err == nil {
+			t.Errorf("SetTrustedProxies(%q) accepted", s)
+		}
+	}
+}
@@ -1,58 +1,299 @@
 package middleware
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
+	"gophermart/internal/config"
+	"gophermart/internal/models"
+	"gophermart/internal/problem"
+	"gophermart/internal/storage"
+
 	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
-var TokenAuth *jwtauth.JWTAuth
+var Keys *KeySet
+
+type cookieAuthCtxKey struct{}
 
-func InitJWT(secret string) {
-	TokenAuth = jwtauth.New("HS256", []byte(secret), nil)
+func InitJWT(cfg config.Config) error {
+	ks, err := NewKeySet(cfg)
+	if err != nil {
+		return err
+	}
+	Keys = ks
+	return nil
 }
 
 func Verifier() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
 			if r.Header.Get("Authorization") == "" {
 				if cookie, err := r.Cookie("auth_token"); err == nil {
 					r.Header.Set("Authorization", "Bearer "+cookie.Value)
+					ctx = context.WithValue(ctx, cookieAuthCtxKey{}, true)
 				}
 			}
-			jwtauth.Verifier(TokenAuth)(next).ServeHTTP(w, r)
+			token, err := VerifyToken(jwtauth.TokenFromHeader(r))
+			ctx = jwtauth.NewContext(ctx, token, err)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func Authenticator() func(http.Handler) http.Handler {
+// VerifyToken checks the token signature against every key in the key set.
+// Tokens issued before key IDs were introduced carry no kid, so the kid is not
+// required and the matching key is found by trying each one.
+func VerifyToken(tokenString string) (jwt.Token, error) {
+	if tokenString == "" {
+		return nil, jwtauth.ErrNoTokenFound
+	}
+	token, err := jwt.Parse([]byte(tokenString),
+		jwt.WithKeySet(Keys.verify, jws.WithRequireKid(false)),
+		jwt.WithValidate(true),
+	)
+	if err != nil {
+		return nil, jwtauth.ErrorReason(err)
+	}
+	return token, nil
+}
+
+// Authenticator rejects requests without a valid token and tokens whose version
+// is older than the user's current one, e.g. after a password change or reset.
+// Requests already authenticated by APIKeyVerifier are let through.
+func Authenticator(store storage.Storage) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			token, _, err := jwtauth.FromContext(r.Context())
-			if err != nil || token == nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			if apiKeyAuthenticated(r) {
+				next.ServeHTTP(w, r)
 				return
 			}
+
+			if _, err := authenticate(r, store); err != nil {
+				if errors.Is(err, errUnauthorized) {
+					unauthorized(w, r)
+				} else {
+					problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to authenticate")
+				}
+				return
+			}
+
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func GenerateToken(userID int) (string, error) {
-	claims := map[string]interface{}{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
+var errUnauthorized = errors.New("unauthorized")
+
+// AuthenticatedUserID reports the user of a request that passed Verifier but is
+// not required to be authenticated, applying the same checks as Authenticator.
+func AuthenticatedUserID(r *http.Request, store storage.Storage) (int, bool, error) {
+	userID, err := authenticate(r, store)
+	if errors.Is(err, errUnauthorized) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return userID, true, nil
+}
+
+// AuthenticateToken checks an access token received outside of HTTP, e.g. in
+// gRPC metadata, the same way Authenticator does.
+func AuthenticateToken(ctx context.Context, store storage.Storage, tokenString string) (int, bool, error) {
+	token, err := VerifyToken(tokenString)
+	if err != nil {
+		return 0, false, nil
+	}
+	claims, err := token.AsMap(ctx)
+	if err != nil {
+		return 0, false, nil
+	}
+
+	userID, err := checkClaims(ctx, store, claims)
+	if errors.Is(err, errUnauthorized) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return userID, true, nil
+}
+
+func authenticate(r *http.Request, store storage.Storage) (int, error) {
+	token, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil || token == nil {
+		return 0, errUnauthorized
+	}
+	return checkClaims(r.Context(), store, claims)
+}
+
+func checkClaims(ctx context.Context, store storage.Storage, claims map[string]interface{}) (int, error) {
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, errUnauthorized
+	}
+	// Tokens issued for other purposes, e.g. a pending second login step, are
+	// not access tokens.
+	if _, ok := claims["purpose"]; ok {
+		return 0, errUnauthorized
+	}
+	tokenVersion, _ := claims["ver"].(float64)
+
+	version, err := store.GetTokenVersion(ctx, int(userID))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return 0, errUnauthorized
+		}
+		return 0, err
+	}
+	if int(tokenVersion) != version {
+		return 0, errUnauthorized
+	}
+
+	// Tokens issued before sessions were introduced carry no session ID and
+	// stay valid until they expire.
+	if sessionID, ok := claims["sid"].(string); ok {
+		session, err := store.GetSession(ctx, sessionID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return 0, errUnauthorized
+			}
+			return 0, err
+		}
+		if session.UserID != int(userID) || session.Revoked || time.Now().After(session.ExpiresAt) {
+			return 0, errUnauthorized
+		}
+		if time.Since(session.LastSeenAt) > time.Minute {
+			if err := store.TouchSession(ctx, sessionID); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return int(userID), nil
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Missing, invalid or expired credentials")
+}
+
+func GenerateToken(user *models.User, session *models.Session) (string, error) {
+	token := jwt.New()
+	token.Set("user_id", user.ID)
+	token.Set("ver", user.TokenVersion)
+	token.Set("sid", session.ID)
+	if len(user.Roles) > 0 {
+		token.Set("roles", user.Roles)
+	}
+	token.Set(jwt.ExpirationKey, session.ExpiresAt.Unix())
+	token.Set(jwt.IssuedAtKey, time.Now().Unix())
+
+	signed, err := jwt.Sign(token, jwt.WithKey(Keys.alg, Keys.signKey))
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// GeneratePurposeToken signs short-lived claims that are not an access token,
+// such as the state of a pending login step. Authenticator rejects them.
+func GeneratePurposeToken(purpose string, claims map[string]interface{}, ttl time.Duration) (string, error) {
+	token := jwt.New()
+	for k, v := range claims {
+		if err := token.Set(k, v); err != nil {
+			return "", err
+		}
+	}
+	token.Set("purpose", purpose)
+	token.Set(jwt.ExpirationKey, time.Now().Add(ttl).Unix())
+	token.Set(jwt.IssuedAtKey, time.Now().Unix())
+
+	signed, err := jwt.Sign(token, jwt.WithKey(Keys.alg, Keys.signKey))
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// ParsePurposeToken verifies a token from GeneratePurposeToken and returns its claims.
+func ParsePurposeToken(purpose, tokenString string) (map[string]interface{}, error) {
+	token, err := VerifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := token.AsMap(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if claims["purpose"] != purpose {
+		return nil, fmt.Errorf("not a %s token", purpose)
 	}
-	_, tokenString, err := TokenAuth.Encode(claims)
-	return tokenString, err
+	return claims, nil
+}
+
+// GenerateMFAToken issues a short-lived token proving that the password was
+// checked. It is exchanged for an access token once the second factor is given.
+func GenerateMFAToken(user *models.User) (string, error) {
+	return GeneratePurposeToken("mfa", map[string]interface{}{
+		"user_id": user.ID,
+		"ver":     user.TokenVersion,
+	}, 5*time.Minute)
+}
+
+// ParseMFAToken verifies a token from GenerateMFAToken and returns the user ID
+// and token version it was issued for.
+func ParseMFAToken(tokenString string) (int, int, error) {
+	claims, err := ParsePurposeToken("mfa", tokenString)
+	if err != nil {
+		return 0, 0, err
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, 0, errors.New("invalid user_id in token")
+	}
+	version, _ := claims["ver"].(float64)
+	return int(userID), int(version), nil
+}
+
+// GetSessionIDFromToken returns the session of a token-authenticated request,
+// or an empty string for API keys and tokens without a session.
+func GetSessionIDFromToken(r *http.Request) string {
+	if apiKeyAuthenticated(r) {
+		return ""
+	}
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		return ""
+	}
+	sessionID, _ := claims["sid"].(string)
+	return sessionID
+}
+
+// GetLoginTimeFromToken returns when the token of a token-authenticated request
+// was issued, which is when the user logged in, or the zero time for API keys.
+func GetLoginTimeFromToken(r *http.Request) time.Time {
+	if apiKeyAuthenticated(r) {
+		return time.Time{}
+	}
+	token, _, err := jwtauth.FromContext(r.Context())
+	if err != nil || token == nil {
+		return time.Time{}
+	}
+	return token.IssuedAt()
 }
 
 func GetUserIDFromToken(r *http.Request) (int, error) {
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		return key.UserID, nil
+	}
+
 	_, claims, err := jwtauth.FromContext(r.Context())
 	if err != nil {
 		return 0, err
@@ -64,4 +305,4 @@ func GetUserIDFromToken(r *http.Request) (int, error) {
 	}
 
 	return int(userID), nil
-}
\ No newline at end of file
+}
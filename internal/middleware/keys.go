@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"gophermart/internal/config"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+// KeySet holds the key used to sign new tokens and every key that is still
+// accepted for verification, so keys can be rotated without logging users out.
+type KeySet struct {
+	alg     jwa.SignatureAlgorithm
+	signKey jwk.Key
+	verify  jwk.Set
+	public  jwk.Set
+}
+
+var supportedAlgs = map[jwa.SignatureAlgorithm]bool{
+	jwa.HS256: true,
+	jwa.RS256: true,
+	jwa.EdDSA: true,
+}
+
+// NewKeySet builds a key set from the configuration. For HS256 the signing key is
+// the JWT secret (or the contents of the key file); for asymmetric algorithms it
+// is a PEM file. Additional verification keys are given as kid=value pairs,
+// where the value may start with the key's algorithm, e.g. kid=HS256:secret or
+// kid=RS256:/path/key.pem, and otherwise uses the signing algorithm. Every key
+// keeps its own algorithm, so tokens signed before switching algorithms stay
+// valid.
+func NewKeySet(cfg config.Config) (*KeySet, error) {
+	alg := jwa.SignatureAlgorithm(cfg.JWTAlg)
+	if !supportedAlgs[alg] {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.JWTAlg)
+	}
+
+	ks := &KeySet{
+		alg:    alg,
+		verify: jwk.NewSet(),
+		public: jwk.NewSet(),
+	}
+
+	signKey, err := loadKey(alg, cfg.JWTKeyFile, cfg.JWTSecret, true)
+	if err != nil {
+		return nil, fmt.Errorf("load signing key: %w", err)
+	}
+	if err := prepareKey(signKey, alg, cfg.JWTKeyID); err != nil {
+		return nil, err
+	}
+	ks.signKey = signKey
+	if err := ks.addVerifyKey(signKey); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range strings.Split(cfg.JWTVerifyKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, value, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || value == "" {
+			return nil, fmt.Errorf("invalid verification key %q, expected kid=value", entry)
+		}
+
+		keyAlg := alg
+		if prefix, rest, ok := strings.Cut(value, ":"); ok && supportedAlgs[jwa.SignatureAlgorithm(prefix)] {
+			keyAlg, value = jwa.SignatureAlgorithm(prefix), rest
+		}
+
+		var key jwk.Key
+		if keyAlg == jwa.HS256 {
+			key, err = loadKey(keyAlg, "", value, false)
+		} else {
+			key, err = loadKey(keyAlg, value, "", false)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("load verification key %s: %w", kid, err)
+		}
+		if err := prepareKey(key, keyAlg, kid); err != nil {
+			return nil, err
+		}
+		if err := ks.addVerifyKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+func loadKey(alg jwa.SignatureAlgorithm, path, secret string, private bool) (jwk.Key, error) {
+	if alg == jwa.HS256 {
+		if path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("empty secret")
+		}
+		return jwk.FromRaw([]byte(secret))
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("%s requires a PEM key file", alg)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwk.ParseKey(data, jwk.WithPEM(true))
+	if err != nil {
+		return nil, err
+	}
+	algs, err := jws.AlgorithmsForKey(key)
+	if err != nil || !slices.Contains(algs, alg) {
+		return nil, fmt.Errorf("%s is not a %s key", path, alg)
+	}
+	if private {
+		if ok, err := jwk.IsPrivateKey(key); err != nil || !ok {
+			return nil, fmt.Errorf("%s is not a private key", path)
+		}
+	}
+	return key, nil
+}
+
+func prepareKey(key jwk.Key, alg jwa.SignatureAlgorithm, kid string) error {
+	if kid == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("compute key thumbprint: %w", err)
+		}
+		kid = base64.RawURLEncoding.EncodeToString(thumbprint)[:16]
+	}
+	if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+		return err
+	}
+	return key.Set(jwk.AlgorithmKey, alg)
+}
+
+func (ks *KeySet) addVerifyKey(key jwk.Key) error {
+	if _, ok := ks.verify.LookupKeyID(key.KeyID()); ok {
+		return fmt.Errorf("duplicate key id %q", key.KeyID())
+	}
+
+	// Symmetric keys are secrets and are never published.
+	if key.KeyType() == jwa.OctetSeq {
+		return ks.verify.AddKey(key)
+	}
+
+	pub, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return fmt.Errorf("derive public key %s: %w", key.KeyID(), err)
+	}
+	if err := pub.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+		return err
+	}
+	if err := ks.verify.AddKey(pub); err != nil {
+		return err
+	}
+	return ks.public.AddKey(pub)
+}
+
+// JWKS serves the public verification keys so other services can validate tokens.
+// Symmetric keys are never published, so with HS256 the set is empty.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(Keys.public)
+}
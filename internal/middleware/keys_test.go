@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gophermart/internal/config"
+	"gophermart/internal/models"
+)
+
+func writeRSAKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func issueToken(t *testing.T, cfg config.Config) string {
+	t.Helper()
+	if err := InitJWT(cfg); err != nil {
+		t.Fatal(err)
+	}
+	token, err := GenerateToken(&models.User{ID: 1}, &models.Session{ID: "s", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestKeyRotationAcrossAlgorithms(t *testing.T) {
+	keyFile := writeRSAKey(t)
+	hsToken := issueToken(t, config.Config{JWTAlg: "HS256", JWTSecret: "old-secret", JWTKeyID: "old"})
+	rsToken := issueToken(t, config.Config{JWTAlg: "RS256", JWTKeyFile: keyFile, JWTKeyID: "new"})
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "HS256 token after switching to RS256",
+			cfg:   config.Config{JWTAlg: "RS256", JWTKeyFile: keyFile, JWTKeyID: "new", JWTVerifyKeys: "old=HS256:old-secret"},
+			token: hsToken,
+		},
+		{
+			name:  "RS256 token",
+			cfg:   config.Config{JWTAlg: "RS256", JWTKeyFile: keyFile, JWTKeyID: "new", JWTVerifyKeys: "old=HS256:old-secret"},
+			token: rsToken,
+		},
+		{
+			name:    "HS256 token without its key",
+			cfg:     config.Config{JWTAlg: "RS256", JWTKeyFile: keyFile, JWTKeyID: "new"},
+			token:   hsToken,
+			wantErr: true,
+		},
+		{
+			name:  "RS256 token after switching back to HS256",
+			cfg:   config.Config{JWTAlg: "HS256", JWTSecret: "next-secret", JWTKeyID: "next", JWTVerifyKeys: "new=RS256:" + keyFile},
+			token: rsToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := InitJWT(tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			_, err := VerifyToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyToken() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyOfWrongType(t *testing.T) {
+	keyFile := writeRSAKey(t)
+	cfg := config.Config{JWTAlg: "HS256", JWTSecret: "secret", JWTVerifyKeys: "old=EdDSA:" + keyFile}
+	if _, err := NewKeySet(cfg); err == nil {
+		t.Fatal("NewKeySet() accepted an RSA key as EdDSA")
+	}
+}
@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gophermart/internal/problem"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// RateLimit allows Requests per Period on a route, as a token bucket that
+// holds up to Requests tokens and refills continuously.
+type RateLimit struct {
+	Method   string
+	Pattern  string
+	Requests int
+	Period   time.Duration
+}
+
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// ParseRateLimits parses a comma-separated list of limits of the form
+// "[METHOD ]PATTERN=REQUESTS/PERIOD", e.g. "POST /api/user/login=5/1m".
+// Patterns use the router syntax, e.g. /api/user/webhooks/{id}.
+func ParseRateLimits(s string) ([]RateLimit, error) {
+	var limits []RateLimit
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		route, rate, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: missing =", item)
+		}
+		var limit RateLimit
+		if method, pattern, ok := strings.Cut(strings.TrimSpace(route), " "); ok {
+			limit.Method, limit.Pattern = strings.ToUpper(method), strings.TrimSpace(pattern)
+		} else {
+			limit.Pattern = method
+		}
+		if !strings.HasPrefix(limit.Pattern, "/") {
+			return nil, fmt.Errorf("rate limit %q: pattern must start with /", item)
+		}
+
+		requests, period, ok := strings.Cut(strings.TrimSpace(rate), "/")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: rate must be REQUESTS/PERIOD", item)
+		}
+		var err error
+		if limit.Requests, err = strconv.Atoi(requests); err != nil || limit.Requests < 1 {
+			return nil, fmt.Errorf("rate limit %q: invalid number of requests", item)
+		}
+		if limit.Period, err = time.ParseDuration(period); err != nil || limit.Period <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid period", item)
+		}
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
+
+// RateLimitStore keeps the token buckets. Take takes a token from the bucket
+// under key and returns the tokens left and whether a token was available.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (float64, bool, error)
+}
+
+// RateLimiter limits requests per user, or per client IP for requests without
+// a valid access token, on the configured routes.
+type RateLimiter struct {
+	store  RateLimitStore
+	limits []RateLimit
+	routes *chi.Mux
+}
+
+func NewRateLimiter(store RateLimitStore, limits []RateLimit) *RateLimiter {
+	// The routes are only used to match requests against the patterns the
+	// same way the application router does.
+	routes := chi.NewRouter()
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for _, limit := range limits {
+		if limit.Method == "" {
+			routes.Handle(limit.Pattern, noop)
+		} else {
+			routes.Method(limit.Method, limit.Pattern, noop)
+		}
+	}
+	return &RateLimiter{store: store, limits: limits, routes: routes}
+}
+
+func (rl *RateLimiter) match(method, path string) (RateLimit, bool) {
+	rctx := chi.NewRouteContext()
+	if !rl.routes.Match(rctx, method, path) {
+		return RateLimit{}, false
+	}
+	pattern := rctx.RoutePattern()
+	for _, limit := range rl.limits {
+		if limit.Pattern == pattern && (limit.Method == "" || limit.Method == method) {
+			return limit, true
+		}
+	}
+	return RateLimit{}, false
+}
+
+// take takes a token for the subject from the bucket of the limit on the
+// route. ok is false if the route is not limited or the store failed.
+func (rl *RateLimiter) take(ctx context.Context, method, path, subject string) (limit RateLimit, tokens float64, allowed, ok bool) {
+	limit, ok = rl.match(method, path)
+	if !ok {
+		return limit, 0, true, false
+	}
+
+	key := limit.Method + " " + limit.Pattern + "|" + subject
+	tokens, allowed, err := rl.store.Take(ctx, key, limit)
+	if err != nil {
+		log.Printf("Rate limit store failed: %v", err)
+		return limit, 0, true, false
+	}
+	return limit, tokens, allowed, true
+}
+
+// Allow takes a token for a call outside the HTTP router, such as a gRPC
+// method, whose path is matched against the configured patterns. If the call
+// is over the limit, it returns false and when to retry.
+func (rl *RateLimiter) Allow(ctx context.Context, method, path, subject string) (time.Duration, bool) {
+	limit, tokens, allowed, _ := rl.take(ctx, method, path, subject)
+	if allowed {
+		return 0, true
+	}
+	return time.Duration(math.Ceil((1-tokens)/limit.perSecond())) * time.Second, false
+}
+
+// Handler answers requests over the limit with 429. Limited routes report
+// the limit in RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset, the
+// seconds until the bucket is full again. If the store fails, requests are
+// let through.
+func (rl *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, tokens, allowed, ok := rl.take(r.Context(), r.Method, r.URL.Path, rateLimitSubject(r))
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		perSecond := limit.perSecond()
+		h := w.Header()
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int(math.Ceil(limit.Period.Seconds()))))
+		h.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(limit.Requests)-tokens)/perSecond))))
+
+		if !allowed {
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil((1-tokens)/perSecond))))
+			problem.Error(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitSubject identifies the client: the user of a valid access token,
+// otherwise the client IP. The token is only verified, not checked against
+// storage, to keep the limiter cheap.
+func rateLimitSubject(r *http.Request) string {
+	tokenString := jwtauth.TokenFromHeader(r)
+	if tokenString == "" {
+		if cookie, err := r.Cookie("auth_token"); err == nil {
+			tokenString = cookie.Value
+		}
+	}
+	if tokenString != "" {
+		if token, err := VerifyToken(tokenString); err == nil {
+			if userID, ok := token.PrivateClaims()["user_id"].(float64); ok {
+				return "user:" + strconv.Itoa(int(userID))
+			}
+		}
+	}
+	return "ip:" + ClientIP(r)
+}
+
+// MemoryRateLimitStore keeps buckets in memory, so every replica limits on
+// its own.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket), lastSweep: time.Now()}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (float64, bool, error) {
+	now := time.Now()
+	burst, perSecond := float64(limit.Requests), limit.perSecond()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Buckets that have refilled completely are the same as missing ones.
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: burst, updated: now}
+		s.buckets[key] = b
+	}
+	tokens, allowed := utils.TakeToken(b.tokens, now.Sub(b.updated), burst, perSecond)
+	b.tokens, b.updated = tokens, now
+	b.full = now.Add(time.Duration((burst - tokens) / perSecond * float64(time.Second)))
+	return tokens, allowed, nil
+}
+
+// StorageRateLimitStore keeps buckets in the database so that all replicas
+// share them. Buckets unused for a day are deleted.
+type StorageRateLimitStore struct {
+	storage   storage.Storage
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewStorageRateLimitStore(storage storage.Storage) *StorageRateLimitStore {
+	return &StorageRateLimitStore{storage: storage}
+}
+
+func (s *StorageRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (float64, bool, error) {
+	s.mu.Lock()
+	if time.Since(s.lastSweep) > time.Hour {
+		s.lastSweep = time.Now()
+		go func() {
+			if err := s.storage.DeleteRateLimitsBefore(context.Background(), time.Now().Add(-24*time.Hour)); err != nil {
+				log.Printf("Failed to delete old rate limits: %v", err)
+			}
+		}()
+	}
+	s.mu.Unlock()
+
+	return s.storage.TakeRateLimitToken(ctx, key, float64(limit.Requests), limit.perSecond())
+}
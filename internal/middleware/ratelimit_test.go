@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []RateLimit
+		wantErr bool
+	}{
+		{name: "empty", in: ""},
+		{
+			name: "method and pattern",
+			in:   "post /api/user/login=5/1m",
+			want: []RateLimit{{Method: "POST", Pattern: "/api/user/login", Requests: 5, Period: time.Minute}},
+		},
+		{
+			name: "any method",
+			in:   "/gophermart.v1.Gophermart/Login=10/1m",
+			want: []RateLimit{{Pattern: "/gophermart.v1.Gophermart/Login", Requests: 10, Period: time.Minute}},
+		},
+		{
+			name: "list with spaces",
+			in:   " POST /api/user/orders=60/1m , ,DELETE /api/user/webhooks/{id} = 5/1h",
+			want: []RateLimit{
+				{Method: "POST", Pattern: "/api/user/orders", Requests: 60, Period: time.Minute},
+				{Method: "DELETE", Pattern: "/api/user/webhooks/{id}", Requests: 5, Period: time.Hour},
+			},
+		},
+		{name: "missing =", in: "POST /api/user/login", wantErr: true},
+		{name: "relative pattern", in: "POST api/user/login=5/1m", wantErr: true},
+		{name: "missing period", in: "POST /api/user/login=5", wantErr: true},
+		{name: "zero requests", in: "POST /api/user/login=0/1m", wantErr: true},
+		{name: "invalid period", in: "POST /api/user/login=5/minute", wantErr: true},
+		{name: "negative period", in: "POST /api/user/login=5/-1m", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRateLimits(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseRateLimits(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
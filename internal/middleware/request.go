@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"gophermart/internal/problem"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestIDHeader echoes the ID assigned by chi's RequestID middleware, so
+// clients can quote it when reporting an error.
+func RequestIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set(middleware.RequestIDHeader, id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Recoverer turns panics into a 500 problem response.
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("panic serving %s %s [%s]: %v\n%s",
+					r.Method, r.URL.Path, middleware.GetReqID(r.Context()), rec, debug.Stack())
+				problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"gophermart/internal/problem"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// RequireRole lets a request through if its token carries at least one of the
+// roles. API keys never carry roles.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if apiKeyAuthenticated(r) {
+				problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "Forbidden")
+				return
+			}
+
+			_, claims, err := jwtauth.FromContext(r.Context())
+			if err != nil {
+				unauthorized(w, r)
+				return
+			}
+
+			for _, role := range RolesFromClaims(claims) {
+				if slices.Contains(roles, role) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "Forbidden")
+		})
+	}
+}
+
+func RolesFromClaims(claims map[string]interface{}) []string {
+	list, _ := claims["roles"].([]interface{})
+	roles := make([]string, 0, len(list))
+	for _, v := range list {
+		if role, ok := v.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -1,11 +1,41 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
-	ID       int    `json:"-"`
-	Login    string `json:"login"`
-	Password string `json:"password"`
+	ID               int    `json:"-"`
+	Login            string `json:"login"`
+	Password         string `json:"password"`
+	TokenVersion     int    `json:"-"`
+	TwoFactorEnabled bool     `json:"-"`
+	Roles            []string `json:"-"`
+}
+
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+var Roles = []string{RoleAdmin, RoleSupport}
+
+type Profile struct {
+	Login         string                  `json:"login"`
+	DisplayName   string                  `json:"display_name"`
+	Email         string                  `json:"email"`
+	EmailVerified bool                    `json:"email_verified"`
+	Phone         string                  `json:"phone"`
+	Locale        string                  `json:"locale"`
+	Notifications NotificationPreferences `json:"notifications"`
+	CreatedAt     time.Time               `json:"created_at"`
+}
+
+type NotificationPreferences struct {
+	OrderUpdates bool `json:"order_updates"`
+	Withdrawals  bool `json:"withdrawals"`
+	Marketing    bool `json:"marketing"`
 }
 
 type Order struct {
@@ -28,8 +58,148 @@ type Withdrawal struct {
 	UserID      int       `json:"-"`
 }
 
+// Types of balance transactions. Accruals and received transfers are credits,
+// withdrawals and sent transfers debits; adjustments go either way.
+const (
+	TransactionAccrual     = "accrual"
+	TransactionWithdrawal  = "withdrawal"
+	TransactionAdjustment  = "adjustment"
+	TransactionTransferIn  = "transfer_in"
+	TransactionTransferOut = "transfer_out"
+)
+
+var TransactionTypes = []string{
+	TransactionAccrual,
+	TransactionWithdrawal,
+	TransactionAdjustment,
+	TransactionTransferIn,
+	TransactionTransferOut,
+}
+
+// BalanceTransaction is an entry of a user's balance history. Amount is
+// positive for credits and negative for debits, Balance is the balance right
+// after the transaction.
+type BalanceTransaction struct {
+	ID      int64   `json:"id"`
+	UserID  int     `json:"-"`
+	Type    string  `json:"type"`
+	Amount  float64 `json:"amount"`
+	Balance float64 `json:"balance"`
+	Order   string  `json:"order,omitempty"`
+	// login of the other user of a transfer
+	Counterparty string    `json:"counterparty,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Transfer moves points from one user to another. The idempotency key is
+// unique per sender, so a retried request does not transfer twice.
+type Transfer struct {
+	ID             int64     `json:"id"`
+	SenderID       int       `json:"-"`
+	RecipientID    int       `json:"-"`
+	Recipient      string    `json:"recipient"`
+	Amount         float64   `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// TransferLimits cap what a user can send per UTC day. Zero values disable
+// the limit.
+type TransferLimits struct {
+	DailySum   float64
+	DailyCount int
+}
+
+// BalanceHistoryFilter selects transactions of the given types created in
+// [From, To). Empty types and zero bounds select everything.
+type BalanceHistoryFilter struct {
+	Types []string
+	From  time.Time
+	To    time.Time
+}
+
 type AccrualResponse struct {
 	Order   string  `json:"order"`
 	Status  string  `json:"status"`
 	Accrual float64 `json:"accrual,omitempty"`
-}
\ No newline at end of file
+}
+
+type OutboxMessage struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type APIKey struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"-"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Hash        string     `json:"-"`
+	Scopes      []string   `json:"scopes"`
+	QuotaPerDay int        `json:"quota_per_day"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"-"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Revoked    bool      `json:"-"`
+	Current    bool      `json:"current"`
+}
+
+type Event struct {
+	ID        int64           `json:"id"`
+	UserID    int             `json:"-"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type Webhook struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	WebhookID     int              `json:"webhook_id"`
+	Event         string           `json:"event"`
+	Payload       json.RawMessage  `json:"payload"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	DeliveredAt   *time.Time       `json:"delivered_at,omitempty"`
+	AttemptLog    []WebhookAttempt `json:"attempt_log"`
+	URL           string           `json:"-"`
+	Secret        string           `json:"-"`
+}
+
+type WebhookAttempt struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+}
@@ -0,0 +1,211 @@
+// Package openapi holds the OpenAPI description of the HTTP API, serves it and
+// validates incoming requests against it.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gophermart/internal/problem"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed openapi.yaml
+var spec []byte
+
+// optionalExtension marks operations whose route is only registered when a
+// feature is configured, e.g. OIDC login.
+const optionalExtension = "x-optional"
+
+// Load parses and validates the embedded document.
+func Load() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parse OpenAPI document: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	return doc, nil
+}
+
+// Handler serves the document as JSON.
+func Handler(doc *openapi3.T) (http.HandlerFunc, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}, nil
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gophermart API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// Docs serves a Swagger UI page for the document.
+func Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
+
+// Validator rejects requests whose parameters or body do not match the
+// document with a validation problem. Requests to paths the document does not
+// know are passed on for the router to answer. Authentication is left to the
+// auth middleware.
+func Validator(doc *openapi3.T) (func(http.Handler) http.Handler, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	options := &openapi3filter.Options{
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		MultiError:         true,
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, pathParams, err := router.FindRoute(r)
+			if err != nil {
+				if errors.Is(err, routers.ErrMethodNotAllowed) || errors.Is(err, routers.ErrPathNotFound) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				problem.Error(w, r, http.StatusInternalServerError, problem.CodeInternal, "Failed to match route")
+				return
+			}
+
+			// Clients have always been able to omit the content type of
+			// bodies, so default to the only one the operation accepts, or
+			// to plain text where that is one of several.
+			if body := route.Operation.RequestBody; body != nil && r.Header.Get("Content-Type") == "" && body.Value != nil {
+				if len(body.Value.Content) == 1 {
+					for mediaType := range body.Value.Content {
+						r.Header.Set("Content-Type", mediaType)
+					}
+				} else if _, ok := body.Value.Content["text/plain"]; ok {
+					r.Header.Set("Content-Type", "text/plain")
+				}
+			}
+
+			input := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options:    options,
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+				problem.Validation(w, r, fieldErrors(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func fieldErrors(err error) []problem.FieldError {
+	var errs []error
+	var multi openapi3.MultiError
+	if errors.As(err, &multi) {
+		errs = multi
+	} else {
+		errs = []error{err}
+	}
+
+	var fields []problem.FieldError
+	for _, err := range errs {
+		fields = append(fields, fieldError(err))
+	}
+	return fields
+}
+
+func fieldError(err error) problem.FieldError {
+	fe := problem.FieldError{Field: "body", Code: "invalid", Message: err.Error()}
+
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) {
+		if reqErr.Parameter != nil {
+			fe.Field = reqErr.Parameter.Name
+		}
+		fe.Message = reqErr.Reason
+		if fe.Message == "" {
+			fe.Message = reqErr.Error()
+		}
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		if path := schemaErr.JSONPointer(); len(path) > 0 && (reqErr == nil || reqErr.Parameter == nil) {
+			fe.Field = strings.Join(path, ".")
+		}
+		if schemaErr.SchemaField != "" {
+			fe.Code = schemaErr.SchemaField
+		}
+		fe.Message = schemaErr.Reason
+	}
+	return fe
+}
+
+// CheckRoutes reports routes registered in the router but missing from the
+// document and operations of the document without a route. Operations marked
+// optional may be missing from the router.
+func CheckRoutes(doc *openapi3.T, router chi.Routes) error {
+	documented := make(map[string]bool)
+	for path, item := range doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			_, optional := op.Extensions[optionalExtension]
+			documented[method+" "+path] = optional
+		}
+	}
+
+	var problems []string
+	err := chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.ReplaceAll(route, "/*/", "/")
+		key := method + " " + strings.TrimSuffix(route, "/*")
+		if _, ok := documented[key]; !ok {
+			problems = append(problems, "undocumented route "+key)
+		}
+		delete(documented, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, optional := range documented {
+		if !optional {
+			problems = append(problems, "documented route not registered "+key)
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("routes and OpenAPI document diverge:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+// Package pb holds the generated gRPC code for proto/gophermart.proto.
+package pb
+
+//go:generate protoc -I ../../proto --go_out=../.. --go_opt=module=gophermart --go-grpc_out=../.. --go-grpc_opt=module=gophermart gophermart.proto
@@ -0,0 +1,120 @@
+// Package problem renders error responses as RFC 7807 problem details.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const ContentType = "application/problem+json"
+
+// Stable error codes. Clients match on these, so existing values must not
+// change.
+const (
+	CodeInvalidRequest      = "invalid_request"
+	CodeValidationFailed    = "validation_failed"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeConflict            = "conflict"
+	CodeRateLimited         = "rate_limited"
+	CodeBodyTooLarge        = "body_too_large"
+	CodeUnsupportedEncoding = "unsupported_encoding"
+	CodeInternal            = "internal_error"
+	CodeUpstreamUnavailable = "upstream_unavailable"
+
+	CodeUserExists            = "user_exists"
+	CodeInvalidCredentials    = "invalid_credentials"
+	CodeLoginLocked           = "login_locked"
+	CodeInvalidPassword       = "invalid_password"
+	CodeReauthRequired        = "reauthentication_required"
+	CodeInvalidResetToken     = "invalid_reset_token"
+	CodeInvalidVerifyToken    = "invalid_verification_token"
+	CodeTwoFactorRequired     = "two_factor_required"
+	CodeInvalidTwoFactorCode  = "invalid_two_factor_code"
+	CodeTwoFactorLocked       = "two_factor_locked"
+	CodeTwoFactorEnabled      = "two_factor_already_enabled"
+	CodeTwoFactorNotEnrolled  = "two_factor_not_enrolled"
+	CodeTwoFactorUnavailable  = "two_factor_unavailable"
+	CodeIdentityLinked        = "identity_linked"
+	CodeEmailTaken            = "email_taken"
+	CodeCSRFFailed            = "csrf_failed"
+	CodeInsufficientScope     = "insufficient_scope"
+	CodeQuotaExceeded         = "quota_exceeded"
+	CodeInvalidOrderNumber    = "invalid_order_number"
+	CodeOrderOwnedByOtherUser = "order_owned_by_other_user"
+	CodeInsufficientFunds     = "insufficient_funds"
+	CodeDuplicateWithdrawal   = "duplicate_withdrawal"
+	CodeUnsupportedFormat     = "unsupported_format"
+	CodeExportBusy            = "export_busy"
+	CodeRecipientNotFound     = "recipient_not_found"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeTransferLimitExceeded = "transfer_limit_exceeded"
+)
+
+// FieldError describes a single invalid input field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Problem is the body of every error response.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// New builds a problem for the request. The type is a URN derived from the
+// code, the request ID is the one assigned by the RequestID middleware.
+func New(r *http.Request, status int, code, detail string) *Problem {
+	return &Problem{
+		Type:      "urn:gophermart:problem:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// Error replies to the request with a problem. Like http.Error, it should be
+// the last write to the response.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	Write(w, New(r, status, code, detail))
+}
+
+// Validation replies with 400 listing every invalid field.
+func Validation(w http.ResponseWriter, r *http.Request, errs []FieldError) {
+	p := New(r, http.StatusBadRequest, CodeValidationFailed, "One or more fields are invalid")
+	p.Errors = errs
+	Write(w, p)
+}
+
+func Write(w http.ResponseWriter, p *Problem) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// NotFound and MethodNotAllowed replace the router's plain text defaults.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Error(w, r, http.StatusNotFound, CodeNotFound, "No such endpoint")
+}
+
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Error(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed for this endpoint")
+}
@@ -0,0 +1,129 @@
+// Package render writes response bodies as JSON or MessagePack, whichever the
+// client prefers in its Accept header.
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	JSON        = "application/json"
+	MessagePack = "application/msgpack"
+)
+
+// msgpackTypes are the media types clients use for MessagePack; none of them
+// is registered, so all are accepted.
+var msgpackTypes = []string{MessagePack, "application/x-msgpack", "application/vnd.msgpack"}
+
+func init() {
+	// Raw JSON, like webhook payloads, is sent as the value it encodes rather
+	// than as bytes.
+	msgpack.Register(json.RawMessage(nil), func(enc *msgpack.Encoder, v reflect.Value) error {
+		raw := v.Bytes()
+		if len(raw) == 0 {
+			return enc.EncodeNil()
+		}
+		var data interface{}
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return err
+		}
+		return enc.Encode(data)
+	}, nil)
+}
+
+type jsonOnlyCtxKey struct{}
+
+// JSONOnly makes the routes it wraps answer with JSON whatever the Accept
+// header says, so that they keep the responses they had before MessagePack
+// was offered.
+func JSONOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jsonOnlyCtxKey{}, true)))
+	})
+}
+
+// Negotiable reports whether the response to r depends on its Accept header.
+func Negotiable(r *http.Request) bool {
+	jsonOnly, _ := r.Context().Value(jsonOnlyCtxKey{}).(bool)
+	return !jsonOnly
+}
+
+// Negotiate returns the media type of the response to r. MessagePack is only
+// chosen when the client prefers it to JSON; anything else gets JSON.
+func Negotiate(r *http.Request) string {
+	if !Negotiable(r) {
+		return JSON
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return JSON
+	}
+	if quality(accept, msgpackTypes) > quality(accept, []string{JSON}) {
+		return MessagePack
+	}
+	return JSON
+}
+
+// quality returns the q value the Accept header gives to the first of types
+// that it matches, taking the most specific media range for each.
+func quality(accept string, types []string) float64 {
+	best, bestSpecificity := 0.0, -1
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+
+		specificity := -1
+		for _, t := range types {
+			switch {
+			case mediaType == t:
+				specificity = 2
+			case mediaType == "*/*":
+				specificity = max(specificity, 0)
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(t, strings.TrimSuffix(mediaType, "*")):
+				specificity = max(specificity, 1)
+			}
+		}
+		if specificity < 0 {
+			continue
+		}
+		if specificity > bestSpecificity || specificity == bestSpecificity && q > best {
+			best, bestSpecificity = q, specificity
+		}
+	}
+	return best
+}
+
+// Write replies with v encoded in the negotiated format.
+func Write(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	contentType := Negotiate(r)
+	w.Header().Set("Content-Type", contentType)
+	if Negotiable(r) {
+		w.Header().Add("Vary", "Accept")
+	}
+	w.WriteHeader(status)
+
+	if contentType == MessagePack {
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		enc.UseCompactInts(true)
+		enc.Encode(v)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: JSON},
+		{accept: "application/json", want: JSON},
+		{accept: "application/msgpack", want: MessagePack},
+		{accept: "application/x-msgpack", want: MessagePack},
+		{accept: "application/vnd.msgpack", want: MessagePack},
+		{accept: "*/*", want: JSON},
+		{accept: "text/html", want: JSON},
+		{accept: "application/msgpack, application/json", want: JSON},
+		{accept: "application/msgpack, application/json;q=0.9", want: MessagePack},
+		{accept: "application/json;q=0.5, application/msgpack;q=0.8", want: MessagePack},
+		{accept: "application/msgpack;q=0.5, */*", want: JSON},
+		{accept: "application/msgpack;q=0.5, application/*", want: JSON},
+		{accept: "application/msgpack, */*;q=0.1", want: MessagePack},
+		{accept: "application/msgpack, application/*;q=0.1", want: MessagePack},
+		{accept: "application/msgpack;q=0, application/json;q=0", want: JSON},
+		{accept: "application/msgpack;q=abc", want: JSON},
+		{accept: "application/msgpack;;", want: JSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			r.Header.Set("Accept", tt.accept)
+			if got := Negotiate(r); got != tt.want {
+				t.Fatalf("Negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONOnly(t *testing.T) {
+	tests := []struct {
+		name            string
+		jsonOnly        bool
+		wantContentType string
+		wantVary        string
+	}{
+		{name: "negotiated", wantContentType: MessagePack, wantVary: "Accept"},
+		{name: "JSON only", jsonOnly: true, wantContentType: JSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Write(w, r, http.StatusOK, map[string]int{"current": 1})
+			})
+			if tt.jsonOnly {
+				handler = JSONOnly(handler)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			r.Header.Set("Accept", MessagePack)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := w.Header().Get("Vary"); got != tt.wantVary {
+				t.Fatalf("Vary = %q, want %q", got, tt.wantVary)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid login or password")
+	ErrTwoFactorRequired  = errors.New("two-factor code required")
+)
+
+// dummyPasswordHash is checked against when the login does not exist, so that
+// the response takes as long as for a wrong password.
+const dummyPasswordHash = "dbf0ac0cc118598458fe77f72a417556:5c352c981e9e28c4f2cd7b78f40bf637b7d0016d97add2c0c418e674440600e5"
+
+// LoginLockedError refuses a login while the login or the client IP is locked
+// out after too many failures.
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// AuthService checks passwords and two-factor codes for the HTTP and gRPC
+// logins, counting failures with the guard.
+type AuthService struct {
+	storage   storage.Storage
+	guard     *LoginGuard
+	twoFactor *TwoFactorService
+}
+
+func NewAuthService(storage storage.Storage, guard *LoginGuard, twoFactor *TwoFactorService) *AuthService {
+	return &AuthService{storage: storage, guard: guard, twoFactor: twoFactor}
+}
+
+// Login returns the user with the normalized login and the password. Users
+// with two-factor authentication also need a code; without one, Login returns
+// the user together with ErrTwoFactorRequired and does not count the attempt,
+// so that the code can follow with SecondFactor.
+func (s *AuthService) Login(ctx context.Context, login, password, code, ip string) (*models.User, error) {
+	if err := s.attempt(ctx, login, ip); err != nil {
+		return nil, err
+	}
+
+	user, err := s.storage.GetUserByLogin(ctx, login)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.CheckPasswordHash(password, dummyPasswordHash)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !utils.CheckPasswordHash(password, user.Password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	// With two-factor authentication the failure counter is kept until the
+	// second step succeeds, so codes cannot be guessed by logging in again.
+	if user.TwoFactorEnabled && code == "" {
+		if err := s.guard.Release(ctx, login, ip); err != nil {
+			log.Printf("Failed to release login attempt for %q: %v", login, err)
+		}
+		return user, ErrTwoFactorRequired
+	}
+	if user.TwoFactorEnabled {
+		if err := s.twoFactor.Verify(ctx, user.ID, code); err != nil {
+			return nil, err
+		}
+	}
+
+	s.succeed(ctx, login, ip)
+	return user, nil
+}
+
+// SecondFactor completes the login of a user for whom Login returned
+// ErrTwoFactorRequired.
+func (s *AuthService) SecondFactor(ctx context.Context, user *models.User, code, ip string) error {
+	if err := s.attempt(ctx, user.Login, ip); err != nil {
+		return err
+	}
+	if err := s.twoFactor.Verify(ctx, user.ID, code); err != nil {
+		return err
+	}
+	s.succeed(ctx, user.Login, ip)
+	return nil
+}
+
+// CheckPassword confirms the password of a signed-in user, like before a
+// password change. Failures count against the login as in Login, so a stolen
+// session cannot be used to guess the password.
+func (s *AuthService) CheckPassword(ctx context.Context, user *models.User, password, ip string) error {
+	if err := s.attempt(ctx, user.Login, ip); err != nil {
+		return err
+	}
+	if !utils.CheckPasswordHash(password, user.Password) {
+		return ErrInvalidCredentials
+	}
+	s.succeed(ctx, user.Login, ip)
+	return nil
+}
+
+func (s *AuthService) attempt(ctx context.Context, login, ip string) error {
+	retryAfter, err := s.guard.Attempt(ctx, login, ip)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+func (s *AuthService) succeed(ctx context.Context, login, ip string) {
+	if err := s.guard.Succeed(ctx, login, ip); err != nil {
+		log.Printf("Failed to reset login failures for %q: %v", login, err)
+	}
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+// userStorage adds a single user to totpStorage.
+type userStorage struct {
+	*totpStorage
+	user models.User
+}
+
+func (s *userStorage) GetUserByLogin(_ context.Context, login string) (*models.User, error) {
+	if login != s.user.Login {
+		return nil, storage.ErrNotFound
+	}
+	user := s.user
+	return &user, nil
+}
+
+func newTestAuth(t *testing.T, twoFactor bool) (*AuthService, *userStorage, string) {
+	t.Helper()
+	hash, err := utils.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := utils.GenerateTOTPSecret()
+	tf, totp := newTestTwoFactor(secret)
+	store := &userStorage{totpStorage: totp, user: models.User{ID: 1, Login: "alice", Password: hash, TwoFactorEnabled: twoFactor}}
+	guard := NewLoginGuard(store, 3, 50, time.Minute, time.Hour)
+	return NewAuthService(store, guard, tf), store, secret
+}
+
+func TestAuthLogin(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		twoFactor bool
+		login     string
+		password  string
+		code      func(secret string) string
+		wantErr   error
+		wantUser  bool
+		wantCount int
+	}{
+		{name: "password", login: "alice", password: "correct horse", wantUser: true},
+		{name: "wrong password", login: "alice", password: "wrong", wantErr: ErrInvalidCredentials, wantCount: 1},
+		{name: "unknown login", login: "bob", password: "correct horse", wantErr: ErrInvalidCredentials, wantCount: 1},
+		{name: "two-factor code missing", twoFactor: true, login: "alice", password: "correct horse", wantErr: ErrTwoFactorRequired, wantUser: true},
+		{name: "two-factor code wrong", twoFactor: true, login: "alice", password: "correct horse", code: func(string) string { return "000000x" }, wantErr: ErrInvalidCode, wantCount: 1},
+		{name: "two-factor code", twoFactor: true, login: "alice", password: "correct horse", code: func(secret string) string { return currentCode(t, secret) }, wantUser: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store, secret := newTestAuth(t, tt.twoFactor)
+			var code string
+			if tt.code != nil {
+				code = tt.code(secret)
+			}
+
+			user, err := s.Login(ctx, tt.login, tt.password, code, "10.0.0.1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if (user != nil) != tt.wantUser {
+				t.Fatalf("user = %v", user)
+			}
+			if n := store.failures[loginKey(tt.login)]; n != tt.wantCount {
+				t.Fatalf("counted failures = %d, want %d", n, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	hash, err := utils.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unknown logins only take as long as known ones if the dummy hash is
+	// compared in full rather than rejected as malformed.
+	salt, sum, _ := strings.Cut(dummyPasswordHash, ":")
+	wantSalt, wantSum, _ := strings.Cut(hash, ":")
+	if len(salt) != len(wantSalt) || len(sum) != len(wantSum) {
+		t.Fatalf("dummy hash %q is not shaped like %q", dummyPasswordHash, hash)
+	}
+	if _, err := hex.DecodeString(salt + sum); err != nil {
+		t.Fatalf("dummy hash is not hex: %v", err)
+	}
+}
+
+func TestAuthLoginLocksOut(t *testing.T) {
+	ctx := context.Background()
+	s, _, _ := newTestAuth(t, false)
+
+	for i := 0; i < 3; i++ {
+		s.Login(ctx, "alice", "wrong", "", "10.0.0.1")
+	}
+	_, err := s.Login(ctx, "alice", "correct horse", "", "10.0.0.1")
+	var locked *LoginLockedError
+	if !errors.As(err, &locked) || locked.RetryAfter <= 0 {
+		t.Fatalf("err = %v, want LoginLockedError", err)
+	}
+}
+
+func TestAuthSecondFactor(t *testing.T) {
+	ctx := context.Background()
+	s, store, secret := newTestAuth(t, true)
+
+	user, err := s.Login(ctx, "alice", "correct horse", "", "10.0.0.1")
+	if !errors.Is(err, ErrTwoFactorRequired) {
+		t.Fatalf("err = %v, want ErrTwoFactorRequired", err)
+	}
+	if err := s.SecondFactor(ctx, user, "000000x", "10.0.0.1"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("wrong code: err = %v", err)
+	}
+	if err := s.SecondFactor(ctx, user, currentCode(t, secret), "10.0.0.1"); err != nil {
+		t.Fatalf("valid code: %v", err)
+	}
+	if n := store.failures[loginKey("alice")]; n != 0 {
+		t.Fatalf("failures after login = %d, want 0", n)
+	}
+}
+
+func TestAuthCheckPassword(t *testing.T) {
+	ctx := context.Background()
+	s, store, _ := newTestAuth(t, false)
+	user := store.user
+
+	// Three wrong guesses lock the login, after which even the right
+	// password is refused.
+	for i := 0; i < 3; i++ {
+		if err := s.CheckPassword(ctx, &user, "wrong", "10.0.0.1"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("guess %d: err = %v, want %v", i+1, err, ErrInvalidCredentials)
+		}
+	}
+	var locked *LoginLockedError
+	if err := s.CheckPassword(ctx, &user, "correct horse", "10.0.0.1"); !errors.As(err, &locked) {
+		t.Fatalf("err = %v, want a lockout", err)
+	}
+	if _, err := s.Login(ctx, "alice", "correct horse", "", "10.0.0.2"); !errors.As(err, &locked) {
+		t.Fatalf("login err = %v, want a lockout", err)
+	}
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+var ErrInvalidAmount = errors.New("amount must be positive")
+
+// BalanceService withdraws and transfers points for the HTTP and gRPC APIs and
+// reports the changes as events and webhooks.
+type BalanceService struct {
+	storage   storage.Storage
+	twoFactor *TwoFactorService
+	events    *EventBroker
+	webhooks  *WebhookDispatcher
+	// withdrawals and transfers of at least this sum need a fresh two-factor
+	// code from users who have it enabled; zero turns the check off
+	twoFactorThreshold float64
+	transferLimits     models.TransferLimits
+}
+
+func NewBalanceService(
+	storage storage.Storage,
+	twoFactor *TwoFactorService,
+	events *EventBroker,
+	webhooks *WebhookDispatcher,
+	twoFactorThreshold float64,
+	transferLimits models.TransferLimits,
+) *BalanceService {
+	return &BalanceService{
+		storage:            storage,
+		twoFactor:          twoFactor,
+		events:             events,
+		webhooks:           webhooks,
+		twoFactorThreshold: twoFactorThreshold,
+		transferLimits:     transferLimits,
+	}
+}
+
+// Withdraw spends sum on the order and returns the time of the withdrawal.
+// Storage errors such as storage.ErrInsufficientFunds are returned as they
+// are.
+func (s *BalanceService) Withdraw(ctx context.Context, userID int, order string, sum float64, code string) (time.Time, error) {
+	if sum <= 0 {
+		return time.Time{}, ErrInvalidAmount
+	}
+	if !utils.IsValidLuhn(order) {
+		return time.Time{}, ErrInvalidOrderNumber
+	}
+	if err := s.checkTwoFactor(ctx, userID, sum, code); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := s.storage.ProcessWithdrawal(ctx, userID, order, sum); err != nil {
+		return time.Time{}, err
+	}
+
+	processedAt := time.Now()
+	s.events.PublishBalance(ctx, userID)
+	s.webhooks.Enqueue(ctx, userID, WebhookWithdrawalCreated, map[string]interface{}{
+		"order":        order,
+		"sum":          sum,
+		"processed_at": processedAt,
+	})
+	return processedAt, nil
+}
+
+// Transfer moves points to the recipient named in the transfer. It reports
+// whether the transfer was made now; a transfer repeated with the same
+// idempotency key is filled in from the original one.
+func (s *BalanceService) Transfer(ctx context.Context, transfer *models.Transfer, code string) (bool, error) {
+	if transfer.Amount <= 0 {
+		return false, ErrInvalidAmount
+	}
+	if err := s.checkTwoFactor(ctx, transfer.SenderID, transfer.Amount, code); err != nil {
+		return false, err
+	}
+
+	created, err := s.storage.Transfer(ctx, transfer, s.transferLimits)
+	if err != nil || !created {
+		return false, err
+	}
+
+	s.events.PublishBalance(ctx, transfer.SenderID)
+	s.events.PublishBalance(ctx, transfer.RecipientID)
+	s.webhooks.Enqueue(ctx, transfer.SenderID, WebhookTransferSent, map[string]interface{}{
+		"id":         transfer.ID,
+		"recipient":  transfer.Recipient,
+		"amount":     transfer.Amount,
+		"created_at": transfer.CreatedAt,
+	})
+	s.webhooks.Enqueue(ctx, transfer.RecipientID, WebhookTransferReceived, map[string]interface{}{
+		"id":         transfer.ID,
+		"amount":     transfer.Amount,
+		"created_at": transfer.CreatedAt,
+	})
+	return true, nil
+}
+
+// checkTwoFactor verifies the two-factor code of users who have it enabled
+// when the sum reaches the threshold. A missing or wrong code gives
+// ErrTwoFactorRequired.
+func (s *BalanceService) checkTwoFactor(ctx context.Context, userID int, sum float64, code string) error {
+	if s.twoFactorThreshold <= 0 || sum < s.twoFactorThreshold {
+		return nil
+	}
+
+	totp, err := s.storage.GetTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !totp.Enabled {
+		return nil
+	}
+
+	if err := s.twoFactor.Verify(ctx, userID, code); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			return ErrTwoFactorRequired
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+// balanceStorage adds a balance and what gets published about it to
+// totpStorage.
+type balanceStorage struct {
+	*totpStorage
+	current    float64
+	events     int
+	deliveries []string
+	// idempotency keys of the transfers made so far
+	transfers map[string]bool
+}
+
+func (s *balanceStorage) ProcessWithdrawal(_ context.Context, _ int, _ string, sum float64) error {
+	if sum > s.current {
+		return storage.ErrInsufficientFunds
+	}
+	s.current -= sum
+	return nil
+}
+
+func (s *balanceStorage) Transfer(_ context.Context, transfer *models.Transfer, _ models.TransferLimits) (bool, error) {
+	if transfer.Recipient == "alice" {
+		return false, storage.ErrSelfTransfer
+	}
+	transfer.RecipientID = 2
+	if s.transfers[transfer.IdempotencyKey] {
+		return false, nil
+	}
+	if transfer.Amount > s.current {
+		return false, storage.ErrInsufficientFunds
+	}
+	if s.transfers == nil {
+		s.transfers = make(map[string]bool)
+	}
+	s.transfers[transfer.IdempotencyKey] = true
+	s.current -= transfer.Amount
+	return true, nil
+}
+
+func (s *balanceStorage) GetBalance(context.Context, int) (*models.Balance, error) {
+	return &models.Balance{Current: s.current}, nil
+}
+
+func (s *balanceStorage) CreateEvent(context.Context, *models.Event) error {
+	s.events++
+	return nil
+}
+
+func (s *balanceStorage) CreateWebhookDeliveries(_ context.Context, _ int, event string, _ []byte) error {
+	s.deliveries = append(s.deliveries, event)
+	return nil
+}
+
+func TestBalanceWithdraw(t *testing.T) {
+	tests := []struct {
+		name      string
+		twoFactor bool
+		sum       float64
+		order     string
+		code      func(secret string) string
+		wantErr   error
+	}{
+		{name: "withdrawal", sum: 50, order: "79927398713"},
+		{name: "not positive", sum: 0, order: "79927398713", wantErr: ErrInvalidAmount},
+		{name: "invalid order", sum: 50, order: "79927398710", wantErr: ErrInvalidOrderNumber},
+		{name: "insufficient funds", sum: 500, order: "79927398713", wantErr: storage.ErrInsufficientFunds},
+		{name: "below the two-factor threshold", twoFactor: true, sum: 50, order: "79927398713"},
+		{name: "two-factor code missing", twoFactor: true, sum: 100, order: "79927398713", wantErr: ErrTwoFactorRequired},
+		{name: "two-factor code wrong", twoFactor: true, sum: 100, order: "79927398713", code: func(string) string { return "000000x" }, wantErr: ErrTwoFactorRequired},
+		{name: "two-factor code", twoFactor: true, sum: 100, order: "79927398713", code: func(secret string) string { return currentCode(t, secret) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, _ := utils.GenerateTOTPSecret()
+			tf, totp := newTestTwoFactor(secret)
+			totp.totp.Enabled = tt.twoFactor
+			store := &balanceStorage{totpStorage: totp, current: 200}
+			s := NewBalanceService(store, tf, NewEventBroker(store, nil), NewWebhookDispatcher(store, false), 100, models.TransferLimits{})
+
+			var code string
+			if tt.code != nil {
+				code = tt.code(secret)
+			}
+			_, err := s.Withdraw(context.Background(), 1, tt.order, tt.sum, code)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			published := err == nil
+			if published != (store.events == 1) || published != (len(store.deliveries) == 1) {
+				t.Fatalf("events = %d, webhooks = %v after err %v", store.events, store.deliveries, err)
+			}
+			if published && store.current != 200-tt.sum {
+				t.Fatalf("balance = %v", store.current)
+			}
+		})
+	}
+}
+
+func TestBalanceTransfer(t *testing.T) {
+	tests := []struct {
+		name        string
+		twoFactor   bool
+		recipient   string
+		amount      float64
+		key         string
+		code        func(secret string) string
+		wantCreated bool
+		wantErr     error
+	}{
+		{name: "transfer", recipient: "bob", amount: 50, key: "new", wantCreated: true},
+		{name: "repeated", recipient: "bob", amount: 50, key: "made"},
+		{name: "not positive", recipient: "bob", amount: 0, key: "new", wantErr: ErrInvalidAmount},
+		{name: "to oneself", recipient: "alice", amount: 50, key: "new", wantErr: storage.ErrSelfTransfer},
+		{name: "insufficient funds", recipient: "bob", amount: 500, key: "new", wantErr: storage.ErrInsufficientFunds},
+		{name: "below the two-factor threshold", twoFactor: true, recipient: "bob", amount: 50, key: "new", wantCreated: true},
+		{name: "two-factor code missing", twoFactor: true, recipient: "bob", amount: 100, key: "new", wantErr: ErrTwoFactorRequired},
+		{name: "two-factor code", twoFactor: true, recipient: "bob", amount: 100, key: "new", code: func(secret string) string { return currentCode(t, secret) }, wantCreated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, _ := utils.GenerateTOTPSecret()
+			tf, totp := newTestTwoFactor(secret)
+			totp.totp.Enabled = tt.twoFactor
+			store := &balanceStorage{totpStorage: totp, current: 200, transfers: map[string]bool{"made": true}}
+			s := NewBalanceService(store, tf, NewEventBroker(store, nil), NewWebhookDispatcher(store, false), 100, models.TransferLimits{})
+
+			var code string
+			if tt.code != nil {
+				code = tt.code(secret)
+			}
+			transfer := &models.Transfer{SenderID: 1, Recipient: tt.recipient, Amount: tt.amount, IdempotencyKey: tt.key}
+			created, err := s.Transfer(context.Background(), transfer, code)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if created != tt.wantCreated {
+				t.Fatalf("created = %v, want %v", created, tt.wantCreated)
+			}
+
+			// both sides hear about a new transfer, nobody about a repeated one
+			if tt.wantCreated {
+				if store.events != 2 || !slices.Equal(store.deliveries, []string{WebhookTransferSent, WebhookTransferReceived}) {
+					t.Fatalf("events = %d, webhooks = %v", store.events, store.deliveries)
+				}
+				if store.current != 200-tt.amount {
+					t.Fatalf("balance = %v", store.current)
+				}
+			} else if store.events != 0 || len(store.deliveries) != 0 {
+				t.Fatalf("events = %d, webhooks = %v after err %v", store.events, store.deliveries, err)
+			}
+		})
+	}
+}
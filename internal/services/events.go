@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+const (
+	EventOrderStatus    = "order.status"
+	EventBalanceUpdated = "balance.updated"
+)
+
+// EventBroker stores user events and wakes up the event streams of this
+// replica when any replica publishes one. Replicas learn about new events
+// through Postgres LISTEN/NOTIFY; the events themselves are read from the
+// user_events table, which lets clients resume after a disconnect.
+type EventBroker struct {
+	storage storage.Storage
+	db      *sql.DB
+
+	mu          sync.Mutex
+	subscribers map[int]map[chan struct{}]struct{}
+}
+
+func NewEventBroker(storage storage.Storage, db *sql.DB) *EventBroker {
+	return &EventBroker{
+		storage:     storage,
+		db:          db,
+		subscribers: make(map[int]map[chan struct{}]struct{}),
+	}
+}
+
+// Publish stores an event for the user. Failures are logged, since events are
+// a convenience and must not fail the change they report.
+func (b *EventBroker) Publish(ctx context.Context, userID int, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", eventType, err)
+		return
+	}
+	event := &models.Event{
+		UserID:    userID,
+		Type:      eventType,
+		Data:      payload,
+		CreatedAt: time.Now(),
+	}
+	if err := b.storage.CreateEvent(ctx, event); err != nil {
+		log.Printf("Failed to publish %s event for user %d: %v", eventType, userID, err)
+	}
+}
+
+// PublishBalance publishes the user's current balance.
+func (b *EventBroker) PublishBalance(ctx context.Context, userID int) {
+	balance, err := b.storage.GetBalance(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to get balance of user %d for event: %v", userID, err)
+		return
+	}
+	b.Publish(ctx, userID, EventBalanceUpdated, balance)
+}
+
+// Subscribe returns a channel that receives a value whenever new events for
+// the user may be available. The returned function unsubscribes.
+func (b *EventBroker) Subscribe(userID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan struct{}]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *EventBroker) wake(userID int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *EventBroker) wakeAll() {
+	b.mu.Lock()
+	users := make([]int, 0, len(b.subscribers))
+	for userID := range b.subscribers {
+		users = append(users, userID)
+	}
+	b.mu.Unlock()
+
+	for _, userID := range users {
+		b.wake(userID)
+	}
+}
+
+// Run listens for notifications until the context is done, reconnecting after
+// errors. Events older than retention are deleted once an hour.
+func (b *EventBroker) Run(ctx context.Context, retention time.Duration) error {
+	go b.cleanup(ctx, retention)
+
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Event listener stopped: %v", err)
+
+		// Notifications sent while reconnecting are lost, so let every
+		// stream look for missed events.
+		b.wakeAll()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (b *EventBroker) listen(ctx context.Context) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+storage.EventsChannel); err != nil {
+			return err
+		}
+		defer pgConn.Exec(context.Background(), "UNLISTEN "+storage.EventsChannel)
+
+		for {
+			n, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+			userID, err := strconv.Atoi(n.Payload)
+			if err != nil {
+				log.Printf("Ignoring event notification with payload %q", n.Payload)
+				continue
+			}
+			b.wake(userID)
+		}
+	})
+}
+
+func (b *EventBroker) cleanup(ctx context.Context, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := b.storage.DeleteEventsBefore(ctx, time.Now().Add(-retention)); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to delete old events: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
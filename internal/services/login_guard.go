@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gophermart/internal/storage"
+)
+
+// LoginGuard tracks failed logins per login and per client IP and locks them
+// out with an exponentially growing delay. Counters live in the database so
+// they survive restarts and are shared between replicas.
+type LoginGuard struct {
+	storage       storage.Storage
+	maxAttempts   int
+	ipMaxAttempts int
+	lockout       time.Duration
+	maxLockout    time.Duration
+}
+
+func NewLoginGuard(storage storage.Storage, maxAttempts, ipMaxAttempts int, lockout, maxLockout time.Duration) *LoginGuard {
+	return &LoginGuard{
+		storage:       storage,
+		maxAttempts:   maxAttempts,
+		ipMaxAttempts: ipMaxAttempts,
+		lockout:       lockout,
+		maxLockout:    maxLockout,
+	}
+}
+
+// Attempt counts a login attempt against the login and the IP before the
+// credentials are checked, so that concurrent guesses cannot all slip in
+// before a lockout applies. It returns how long the login or IP remains locked
+// if the attempt is refused, or zero if it may go ahead. Attempts that turn
+// out right are taken back with Release or Succeed.
+func (g *LoginGuard) Attempt(ctx context.Context, login, ip string) (time.Duration, error) {
+	allowed, err := g.storage.AttemptLogin(ctx, loginKey(login), g.maxAttempts, g.lockout, g.maxLockout)
+	if err != nil {
+		return 0, err
+	}
+	if allowed {
+		allowed, err = g.storage.AttemptLogin(ctx, ipKey(ip), g.ipMaxAttempts, g.lockout, g.maxLockout)
+		if err != nil {
+			return 0, err
+		}
+		if !allowed {
+			if err := g.storage.ReleaseLoginAttempt(ctx, loginKey(login), g.maxAttempts); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if allowed {
+		return 0, nil
+	}
+
+	lockedUntil, err := g.storage.GetLoginLock(ctx, loginKey(login), ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	// The lock may have just expired; one second still tells the client to
+	// retry rather than to give up.
+	return max(time.Until(lockedUntil), time.Second), nil
+}
+
+// Release takes back an attempt whose credentials were right but which did
+// not complete the login yet, like a password followed by a two-factor code.
+func (g *LoginGuard) Release(ctx context.Context, login, ip string) error {
+	if err := g.storage.ReleaseLoginAttempt(ctx, loginKey(login), g.maxAttempts); err != nil {
+		return err
+	}
+	return g.storage.ReleaseLoginAttempt(ctx, ipKey(ip), g.ipMaxAttempts)
+}
+
+// Succeed clears the failure counter of the login and takes back the attempt
+// from the IP. The rest of the IP counter is kept so that logging into an own
+// account does not reset an attack from the same IP.
+func (g *LoginGuard) Succeed(ctx context.Context, login, ip string) error {
+	if err := g.storage.ResetLoginFailures(ctx, loginKey(login)); err != nil {
+		return err
+	}
+	return g.storage.ReleaseLoginAttempt(ctx, ipKey(ip), g.ipMaxAttempts)
+}
+
+// AttemptCode counts a two-factor code of the user as failed before it is
+// checked, like Attempt does for passwords, and reports whether it may be
+// checked. Codes share the login limits but are counted per user, so that a
+// code cannot be guessed through every flow that asks for one.
+func (g *LoginGuard) AttemptCode(ctx context.Context, userID int) (bool, error) {
+	return g.storage.AttemptLogin(ctx, codeKey(userID), g.maxAttempts, g.lockout, g.maxLockout)
+}
+
+// CodeAccepted clears the failed two-factor codes of the user.
+func (g *LoginGuard) CodeAccepted(ctx context.Context, userID int) error {
+	return g.storage.ResetLoginFailures(ctx, codeKey(userID))
+}
+
+// Unlock clears failures and lockouts for a login or an IP address.
+func (g *LoginGuard) Unlock(ctx context.Context, loginOrIP string) error {
+	return g.storage.ResetLoginFailures(ctx, loginKey(loginOrIP), ipKey(loginOrIP))
+}
+
+func loginKey(login string) string {
+	return "login:" + login
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func codeKey(userID int) string {
+	return "totp:" + strconv.Itoa(userID)
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gophermart/internal/storage"
+)
+
+// attemptStorage keeps login attempts in memory the way DBStorage does.
+type attemptStorage struct {
+	storage.Storage
+	mu       sync.Mutex
+	failures map[string]int
+	locked   map[string]time.Time
+}
+
+func newAttemptStorage() *attemptStorage {
+	return &attemptStorage{failures: make(map[string]int), locked: make(map[string]time.Time)}
+}
+
+func (s *attemptStorage) AttemptLogin(_ context.Context, key string, limit int, lockout, _ time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.locked[key]) {
+		return false, nil
+	}
+	s.failures[key]++
+	if s.failures[key] >= limit {
+		s.locked[key] = time.Now().Add(lockout)
+	}
+	return true, nil
+}
+
+func (s *attemptStorage) ReleaseLoginAttempt(_ context.Context, key string, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures[key] > 0 {
+		s.failures[key]--
+	}
+	if s.failures[key] < limit {
+		delete(s.locked, key)
+	}
+	return nil
+}
+
+func (s *attemptStorage) ResetLoginFailures(_ context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.failures, key)
+		delete(s.locked, key)
+	}
+	return nil
+}
+
+func (s *attemptStorage) GetLoginLock(_ context.Context, keys ...string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var until time.Time
+	for _, key := range keys {
+		if s.locked[key].After(until) {
+			until = s.locked[key]
+		}
+	}
+	return until, nil
+}
+
+func TestLoginGuardConcurrentAttempts(t *testing.T) {
+	store := newAttemptStorage()
+	guard := NewLoginGuard(store, 3, 100, time.Minute, time.Hour)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retryAfter, err := guard.Attempt(context.Background(), "alice", "10.0.0.1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if retryAfter == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 3 {
+		t.Fatalf("allowed %d concurrent attempts, want 3", allowed)
+	}
+}
+
+func TestLoginGuard(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		run     func(g *LoginGuard)
+		login   string
+		ip      string
+		allowed bool
+	}{
+		{
+			name:    "first attempt",
+			run:     func(g *LoginGuard) {},
+			login:   "alice",
+			ip:      "10.0.0.1",
+			allowed: true,
+		},
+		{
+			name: "login locked after failures",
+			run: func(g *LoginGuard) {
+				for i := 0; i < 3; i++ {
+					g.Attempt(ctx, "alice", "10.0.0.1")
+				}
+			},
+			login:   "alice",
+			ip:      "10.0.0.2",
+			allowed: false,
+		},
+		{
+			name: "other login not affected",
+			run: func(g *LoginGuard) {
+				for i := 0; i < 3; i++ {
+					g.Attempt(ctx, "alice", "10.0.0.1")
+				}
+			},
+			login:   "bob",
+			ip:      "10.0.0.2",
+			allowed: true,
+		},
+		{
+			name: "successful logins are not counted",
+			run: func(g *LoginGuard) {
+				for i := 0; i < 5; i++ {
+					g.Attempt(ctx, "alice", "10.0.0.1")
+					g.Succeed(ctx, "alice", "10.0.0.1")
+				}
+			},
+			login:   "alice",
+			ip:      "10.0.0.1",
+			allowed: true,
+		},
+		{
+			name: "released attempts are not counted",
+			run: func(g *LoginGuard) {
+				for i := 0; i < 5; i++ {
+					g.Attempt(ctx, "alice", "10.0.0.1")
+					g.Release(ctx, "alice", "10.0.0.1")
+				}
+			},
+			login:   "alice",
+			ip:      "10.0.0.1",
+			allowed: true,
+		},
+		{
+			name: "ip locked across logins",
+			run: func(g *LoginGuard) {
+				for _, login := range []string{"a", "b", "c", "d", "e"} {
+					g.Attempt(ctx, login, "10.0.0.1")
+				}
+			},
+			login:   "f",
+			ip:      "10.0.0.1",
+			allowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := NewLoginGuard(newAttemptStorage(), 3, 5, time.Minute, time.Hour)
+			tt.run(guard)
+
+			retryAfter, err := guard.Attempt(ctx, tt.login, tt.ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed := retryAfter == 0; allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v (retry after %s)", allowed, tt.allowed, retryAfter)
+			}
+		})
+	}
+}
+
+func TestLoginGuardRefusedIPReleasesLogin(t *testing.T) {
+	ctx := context.Background()
+	store := newAttemptStorage()
+	guard := NewLoginGuard(store, 3, 1, time.Minute, time.Hour)
+
+	guard.Attempt(ctx, "alice", "10.0.0.1")
+	if retryAfter, _ := guard.Attempt(ctx, "bob", "10.0.0.1"); retryAfter == 0 {
+		t.Fatal("attempt from a locked IP was allowed")
+	}
+	if got := store.failures[loginKey("bob")]; got != 0 {
+		t.Fatalf("refused attempt left %d failures on the login", got)
+	}
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+)
+
+// Notifier delivers messages such as password reset links to users.
+type Notifier interface {
+	Notify(ctx context.Context, msg *models.OutboxMessage) error
+}
+
+// OutboxNotifier stores messages in the outbox table, from where an external
+// mailer can pick them up.
+type OutboxNotifier struct {
+	storage storage.Storage
+}
+
+func NewOutboxNotifier(storage storage.Storage) *OutboxNotifier {
+	return &OutboxNotifier{storage: storage}
+}
+
+func (n *OutboxNotifier) Notify(ctx context.Context, msg *models.OutboxMessage) error {
+	return n.storage.CreateOutboxMessage(ctx, msg)
+}
+
+// FileNotifier appends messages as JSON lines to a local file.
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (n *FileNotifier) Notify(ctx context.Context, msg *models.OutboxMessage) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(msg)
+}
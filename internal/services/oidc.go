@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// OIDCProvider implements the authorization code flow with PKCE against an
+// OpenID Connect identity provider found by discovery.
+type OIDCProvider struct {
+	client       *http.Client
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	mu       sync.Mutex
+	metadata *oidcMetadata
+	keys     *jwk.Cache
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCIdentity is what gophermart learns about a user from a verified ID token.
+type OIDCIdentity struct {
+	Issuer            string
+	Subject           string
+	PreferredUsername string
+	Email             string
+	EmailVerified     bool
+}
+
+func NewOIDCProvider(client *http.Client, issuer, clientID, clientSecret, redirectURL string) *OIDCProvider {
+	return &OIDCProvider{
+		client:       client,
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		keys:         jwk.NewCache(context.Background()),
+	}
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected discovery status code: %d", resp.StatusCode)
+	}
+
+	var metadata oidcMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+	if strings.TrimRight(metadata.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", metadata.Issuer)
+	}
+	if err := p.keys.Register(metadata.JWKSURI, jwk.WithHTTPClient(p.client)); err != nil {
+		return nil, err
+	}
+
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// AuthCodeURL returns the URL of the provider's login page.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.clientID)
+	v.Set("redirect_uri", p.redirectURL)
+	v.Set("scope", "openid profile email")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", codeChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return metadata.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange redeems the authorization code and verifies the returned ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*OIDCIdentity, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected token status code: %d", resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	return p.verifyIDToken(ctx, metadata, tokens.IDToken, nonce)
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, metadata *oidcMetadata, idToken, nonce string) (*OIDCIdentity, error) {
+	keys, err := p.keys.Get(ctx, metadata.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch provider keys: %w", err)
+	}
+
+	parse := func(keys jwk.Set) (jwt.Token, error) {
+		return jwt.Parse([]byte(idToken),
+			jwt.WithKeySet(keys),
+			jwt.WithValidate(true),
+			jwt.WithIssuer(metadata.Issuer),
+			jwt.WithAudience(p.clientID),
+			jwt.WithClaimValue("nonce", nonce),
+		)
+	}
+
+	token, err := parse(keys)
+	if err != nil {
+		// The provider may have rotated its keys since they were cached.
+		if keys, err = p.keys.Refresh(ctx, metadata.JWKSURI); err != nil {
+			return nil, fmt.Errorf("failed to refresh provider keys: %w", err)
+		}
+		if token, err = parse(keys); err != nil {
+			return nil, fmt.Errorf("invalid id_token: %w", err)
+		}
+	}
+
+	identity := &OIDCIdentity{
+		Issuer:  metadata.Issuer,
+		Subject: token.Subject(),
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("id_token has no subject")
+	}
+	if v, ok := token.Get("preferred_username"); ok {
+		identity.PreferredUsername, _ = v.(string)
+	}
+	if v, ok := token.Get("email"); ok {
+		identity.Email, _ = v.(string)
+	}
+	if v, ok := token.Get("email_verified"); ok {
+		// Some providers send the claim as a string.
+		switch v := v.(type) {
+		case bool:
+			identity.EmailVerified = v
+		case string:
+			identity.EmailVerified = v == "true"
+		}
+	}
+	return identity, nil
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
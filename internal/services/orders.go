@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+var (
+	ErrInvalidOrderNumber    = errors.New("invalid order number")
+	ErrOrderOwnedByOtherUser = errors.New("order already uploaded by another user")
+)
+
+// OrderService uploads orders for the HTTP and gRPC APIs.
+type OrderService struct {
+	storage storage.Storage
+}
+
+func NewOrderService(storage storage.Storage) *OrderService {
+	return &OrderService{storage: storage}
+}
+
+// Upload stores a new order for the user. It reports whether the order was
+// created; uploading one of the user's own orders again returns it unchanged.
+func (s *OrderService) Upload(ctx context.Context, userID int, number string) (*models.Order, bool, error) {
+	if !utils.IsValidLuhn(number) {
+		return nil, false, ErrInvalidOrderNumber
+	}
+
+	order, err := s.existing(ctx, userID, number)
+	if err == nil || !errors.Is(err, storage.ErrOrderNotFound) {
+		return order, false, err
+	}
+
+	order = &models.Order{
+		Number:     number,
+		Status:     "NEW",
+		UploadedAt: time.Now(),
+		UserID:     userID,
+	}
+	if err := s.storage.CreateOrder(ctx, order); err != nil {
+		if errors.Is(err, storage.ErrOrderExists) {
+			// uploaded concurrently since the check above
+			order, err = s.existing(ctx, userID, number)
+			return order, false, err
+		}
+		return nil, false, err
+	}
+	return order, true, nil
+}
+
+func (s *OrderService) existing(ctx context.Context, userID int, number string) (*models.Order, error) {
+	order, err := s.storage.GetOrderByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, ErrOrderOwnedByOtherUser
+	}
+	return order, nil
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+)
+
+type orderStorage struct {
+	storage.Storage
+	orders map[string]models.Order
+	// raced is inserted by another upload between the check and the insert
+	raced *models.Order
+}
+
+func (s *orderStorage) GetOrderByNumber(_ context.Context, number string) (*models.Order, error) {
+	order, ok := s.orders[number]
+	if !ok {
+		return nil, storage.ErrOrderNotFound
+	}
+	return &order, nil
+}
+
+func (s *orderStorage) CreateOrder(_ context.Context, order *models.Order) error {
+	if s.raced != nil {
+		s.orders[s.raced.Number] = *s.raced
+	}
+	if _, ok := s.orders[order.Number]; ok {
+		return storage.ErrOrderExists
+	}
+	s.orders[order.Number] = *order
+	return nil
+}
+
+func TestOrderUpload(t *testing.T) {
+	tests := []struct {
+		name        string
+		number      string
+		existing    []models.Order
+		raced       *models.Order
+		wantErr     error
+		wantCreated bool
+	}{
+		{name: "new", number: "79927398713", wantCreated: true},
+		{name: "invalid number", number: "79927398710", wantErr: ErrInvalidOrderNumber},
+		{name: "own order again", number: "79927398713", existing: []models.Order{{Number: "79927398713", UserID: 1}}},
+		{name: "other user's order", number: "79927398713", existing: []models.Order{{Number: "79927398713", UserID: 2}}, wantErr: ErrOrderOwnedByOtherUser},
+		{name: "uploaded concurrently by another user", number: "79927398713", raced: &models.Order{Number: "79927398713", UserID: 2}, wantErr: ErrOrderOwnedByOtherUser},
+		{name: "uploaded concurrently by the user", number: "79927398713", raced: &models.Order{Number: "79927398713", UserID: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &orderStorage{orders: make(map[string]models.Order), raced: tt.raced}
+			for _, order := range tt.existing {
+				store.orders[order.Number] = order
+			}
+			s := NewOrderService(store)
+
+			order, created, err := s.Upload(context.Background(), 1, tt.number)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if created != tt.wantCreated {
+				t.Fatalf("created = %v, want %v", created, tt.wantCreated)
+			}
+			if err == nil && (order.Number != tt.number || order.UserID != 1) {
+				t.Fatalf("order = %+v", order)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+	"gophermart/internal/utils"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	ErrInvalidCode          = errors.New("invalid two-factor code")
+	ErrTwoFactorLocked      = errors.New("too many invalid two-factor codes")
+	ErrTwoFactorUnavailable = errors.New("two-factor authentication needs a TOTP key")
+)
+
+// TwoFactorService manages TOTP enrollment and checks TOTP and recovery codes.
+// Secrets are stored encrypted with key, and failed codes are counted by the
+// guard. Without a key nobody can enroll.
+type TwoFactorService struct {
+	storage storage.Storage
+	guard   *LoginGuard
+	issuer  string
+	key     []byte
+}
+
+func NewTwoFactorService(storage storage.Storage, guard *LoginGuard, issuer string, key []byte) *TwoFactorService {
+	return &TwoFactorService{storage: storage, guard: guard, issuer: issuer, key: key}
+}
+
+// EncryptSecrets encrypts the secrets stored in plain text by earlier versions.
+func (s *TwoFactorService) EncryptSecrets(ctx context.Context) error {
+	secrets, err := s.storage.GetPlainTOTPSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	if len(secrets) > 0 && s.key == nil {
+		return ErrTwoFactorUnavailable
+	}
+	for userID, secret := range secrets {
+		sealed, err := utils.SealSecret(s.key, secret)
+		if err != nil {
+			return err
+		}
+		if err := s.storage.ReplaceTOTPSecret(ctx, userID, secret, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enroll generates a new pending secret. It has no effect on login until it is
+// confirmed with Confirm.
+func (s *TwoFactorService) Enroll(ctx context.Context, user *models.User) (secret, url string, err error) {
+	if s.key == nil {
+		return "", "", ErrTwoFactorUnavailable
+	}
+	secret, err = utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := utils.SealSecret(s.key, secret)
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.storage.SetTOTPSecret(ctx, user.ID, sealed); err != nil {
+		return "", "", err
+	}
+	return secret, utils.TOTPURL(s.issuer, user.Login, secret), nil
+}
+
+// Confirm enables the pending secret if the code matches and returns freshly
+// generated recovery codes. They are only stored hashed.
+func (s *TwoFactorService) Confirm(ctx context.Context, userID int, code string) ([]string, error) {
+	totp, err := s.storage.GetTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if totp.Enabled {
+		return nil, storage.ErrTwoFactorEnabled
+	}
+	if totp.Secret == "" {
+		return nil, ErrInvalidCode
+	}
+	if err := s.attempt(ctx, userID); err != nil {
+		return nil, err
+	}
+	secret, err := utils.OpenSecret(s.key, totp.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := utils.MatchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if err := s.guard.CodeAccepted(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		hexCode := hex.EncodeToString(raw)
+		codes[i] = hexCode[:5] + "-" + hexCode[5:]
+		hashes[i] = utils.HashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	if err := s.storage.EnableTOTP(ctx, userID, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify accepts either a current TOTP code or an unused recovery code. Both
+// are single-use. Once too many codes have failed, it returns
+// ErrTwoFactorLocked until the lockout expires.
+func (s *TwoFactorService) Verify(ctx context.Context, userID int, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return ErrInvalidCode
+	}
+
+	totp, err := s.storage.GetTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !totp.Enabled {
+		return ErrInvalidCode
+	}
+	if err := s.attempt(ctx, userID); err != nil {
+		return err
+	}
+	secret, err := utils.OpenSecret(s.key, totp.Secret)
+	if err != nil {
+		return err
+	}
+
+	if step, ok := utils.MatchTOTP(secret, code, time.Now()); ok {
+		fresh, err := s.storage.UseTOTPStep(ctx, userID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrInvalidCode
+		}
+		return s.guard.CodeAccepted(ctx, userID)
+	}
+
+	used, err := s.storage.UseRecoveryCode(ctx, userID, utils.HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCode
+	}
+	return s.guard.CodeAccepted(ctx, userID)
+}
+
+func (s *TwoFactorService) Disable(ctx context.Context, userID int, code string) error {
+	if err := s.Verify(ctx, userID, code); err != nil {
+		return err
+	}
+	return s.storage.DisableTOTP(ctx, userID)
+}
+
+// attempt counts a code as failed until it is accepted.
+func (s *TwoFactorService) attempt(ctx context.Context, userID int) error {
+	allowed, err := s.guard.AttemptCode(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrTwoFactorLocked
+	}
+	return nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(code, "-", ""))
+}
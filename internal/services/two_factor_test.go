@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/utils"
+)
+
+// totpStorage adds the TOTP columns of a single user to attemptStorage.
+type totpStorage struct {
+	*attemptStorage
+	totp models.TOTP
+}
+
+func (s *totpStorage) GetTOTP(context.Context, int) (*models.TOTP, error) {
+	totp := s.totp
+	return &totp, nil
+}
+
+func (s *totpStorage) SetTOTPSecret(_ context.Context, _ int, secret string) error {
+	s.totp.Secret = secret
+	return nil
+}
+
+func (s *totpStorage) UseTOTPStep(_ context.Context, _ int, step int64) (bool, error) {
+	if step <= s.totp.LastStep {
+		return false, nil
+	}
+	s.totp.LastStep = step
+	return true, nil
+}
+
+func (s *totpStorage) UseRecoveryCode(context.Context, int, string) (bool, error) {
+	return false, nil
+}
+
+func (s *totpStorage) GetPlainTOTPSecrets(context.Context) (map[int]string, error) {
+	if s.totp.Secret == "" || utils.IsSealed(s.totp.Secret) {
+		return nil, nil
+	}
+	return map[int]string{1: s.totp.Secret}, nil
+}
+
+func (s *totpStorage) ReplaceTOTPSecret(_ context.Context, _ int, old, secret string) error {
+	if s.totp.Secret == old {
+		s.totp.Secret = secret
+	}
+	return nil
+}
+
+func newTestTwoFactor(secret string) (*TwoFactorService, *totpStorage) {
+	store := &totpStorage{attemptStorage: newAttemptStorage(), totp: models.TOTP{Secret: secret, Enabled: true}}
+	guard := NewLoginGuard(store, 3, 50, time.Minute, time.Hour)
+	return NewTwoFactorService(store, guard, "Gophermart", utils.SecretKey("test")), store
+}
+
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+	code, err := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTwoFactorVerifyLocksOut(t *testing.T) {
+	ctx := context.Background()
+	secret, _ := utils.GenerateTOTPSecret()
+	s, _ := newTestTwoFactor(secret)
+
+	for i := 0; i < 3; i++ {
+		if err := s.Verify(ctx, 1, "000000x"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidCode", i+1, err)
+		}
+	}
+	if err := s.Verify(ctx, 1, currentCode(t, secret)); !errors.Is(err, ErrTwoFactorLocked) {
+		t.Fatalf("valid code after lockout: got %v, want ErrTwoFactorLocked", err)
+	}
+}
+
+func TestTwoFactorVerifyResetsFailures(t *testing.T) {
+	ctx := context.Background()
+	secret, _ := utils.GenerateTOTPSecret()
+	s, store := newTestTwoFactor(secret)
+
+	s.Verify(ctx, 1, "000000x")
+	s.Verify(ctx, 1, "000000x")
+	if err := s.Verify(ctx, 1, currentCode(t, secret)); err != nil {
+		t.Fatalf("valid code: %v", err)
+	}
+	if n := store.failures[codeKey(1)]; n != 0 {
+		t.Fatalf("failures after a valid code = %d, want 0", n)
+	}
+}
+
+func TestTwoFactorSecretsEncrypted(t *testing.T) {
+	ctx := context.Background()
+	secret, _ := utils.GenerateTOTPSecret()
+	s, store := newTestTwoFactor(secret)
+
+	if err := s.EncryptSecrets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !utils.IsSealed(store.totp.Secret) {
+		t.Fatalf("stored secret %q is not encrypted", store.totp.Secret)
+	}
+	if err := s.Verify(ctx, 1, currentCode(t, secret)); err != nil {
+		t.Fatalf("valid code after encrypting the secret: %v", err)
+	}
+
+	enrolled, _, err := s.Enroll(ctx, &models.User{ID: 1, Login: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.IsSealed(store.totp.Secret) || store.totp.Secret == enrolled {
+		t.Fatal("enrolled secret stored in plain text")
+	}
+}
+
+func TestTwoFactorWithoutKey(t *testing.T) {
+	ctx := context.Background()
+	store := &totpStorage{attemptStorage: newAttemptStorage()}
+	guard := NewLoginGuard(store, 3, 50, time.Minute, time.Hour)
+	s := NewTwoFactorService(store, guard, "Gophermart", nil)
+
+	if err := s.EncryptSecrets(ctx); err != nil {
+		t.Fatalf("no secrets to encrypt: err = %v", err)
+	}
+	if _, _, err := s.Enroll(ctx, &models.User{ID: 1, Login: "alice"}); !errors.Is(err, ErrTwoFactorUnavailable) {
+		t.Fatalf("Enroll() err = %v, want %v", err, ErrTwoFactorUnavailable)
+	}
+	if store.totp.Secret != "" {
+		t.Fatalf("secret %q stored without a key", store.totp.Secret)
+	}
+
+	store.totp.Secret = "JBSWY3DPEHPK3PXP"
+	if err := s.EncryptSecrets(ctx); !errors.Is(err, ErrTwoFactorUnavailable) {
+		t.Fatalf("EncryptSecrets() err = %v, want %v", err, ErrTwoFactorUnavailable)
+	}
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+)
+
+const (
+	WebhookOrderProcessed    = "order.processed"
+	WebhookOrderInvalid      = "order.invalid"
+	WebhookWithdrawalCreated = "withdrawal.created"
+	WebhookTransferSent      = "transfer.sent"
+	WebhookTransferReceived  = "transfer.received"
+)
+
+// WebhookEvents lists the event types webhooks can subscribe to.
+var WebhookEvents = []string{
+	WebhookOrderProcessed,
+	WebhookOrderInvalid,
+	WebhookWithdrawalCreated,
+	WebhookTransferSent,
+	WebhookTransferReceived,
+}
+
+const (
+	WebhookSignatureHeader = "X-Gophermart-Signature"
+	WebhookEventHeader     = "X-Gophermart-Event"
+	WebhookDeliveryHeader  = "X-Gophermart-Delivery"
+)
+
+const (
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookBatch       = 20
+	webhookTimeout     = 10 * time.Second
+	// a claimed delivery is retried after the lease if its sender never
+	// records the attempt; the deliveries of a batch are sent in parallel, so
+	// the lease only has to outlast a single request
+	webhookLease = 6 * webhookTimeout
+)
+
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// WebhookDispatcher queues webhook deliveries and sends them with retries.
+// Deliveries are stored first, so they survive restarts and can be sent by
+// any replica.
+type WebhookDispatcher struct {
+	storage storage.Storage
+	client  *http.Client
+}
+
+// NewWebhookDispatcher returns a dispatcher. Unless allowPrivate is set,
+// webhooks cannot reach loopback, private or link-local addresses.
+func NewWebhookDispatcher(storage storage.Storage, allowPrivate bool) *WebhookDispatcher {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &WebhookDispatcher{
+		storage: storage,
+		client: &http.Client{
+			Timeout:   webhookTimeout,
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Enqueue queues the event for the user's subscribed webhooks. Failures are
+// logged, like for Publish on the event broker.
+func (d *WebhookDispatcher) Enqueue(ctx context.Context, userID int, event string, data interface{}) {
+	payload, err := json.Marshal(struct {
+		Event     string      `json:"event"`
+		CreatedAt time.Time   `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{event, time.Now().UTC(), data})
+	if err != nil {
+		log.Printf("Failed to encode %s webhook: %v", event, err)
+		return
+	}
+	if err := d.storage.CreateWebhookDeliveries(ctx, userID, event, payload); err != nil {
+		log.Printf("Failed to queue %s webhook for user %d: %v", event, userID, err)
+	}
+}
+
+// SignWebhook returns the signature header value for the body: the Unix
+// timestamp and the hex HMAC-SHA256 of "<timestamp>.<body>" under the secret.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Run sends due deliveries until the context is done.
+func (d *WebhookDispatcher) Run(ctx context.Context) error {
+	for {
+		n, err := d.dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Webhook dispatch error: %v", err)
+		}
+		if n == webhookBatch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context) (int, error) {
+	deliveries, err := d.storage.ClaimWebhookDeliveries(ctx, webhookBatch, webhookLease)
+	if err != nil {
+		return 0, fmt.Errorf("claim deliveries: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// deliver sends the delivery once and records the outcome.
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery models.WebhookDelivery) {
+	attempt := d.send(ctx, delivery)
+
+	status := "succeeded"
+	var next *time.Time
+	if attempt.Error != "" || attempt.StatusCode < 200 || attempt.StatusCode >= 300 {
+		status = "failed"
+		if delivery.Attempts+1 < webhookMaxAttempts {
+			status = "pending"
+			at := time.Now().Add(webhookBackoff(delivery.Attempts + 1))
+			next = &at
+		}
+	}
+
+	if err := d.storage.RecordWebhookAttempt(ctx, delivery.ID, attempt, status, next); err != nil {
+		log.Printf("Failed to record webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+func (d *WebhookDispatcher) send(ctx context.Context, delivery models.WebhookDelivery) models.WebhookAttempt {
+	start := time.Now()
+	attempt := models.WebhookAttempt{AttemptedAt: start}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gophermart-Webhooks/1.0")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.Secret, start, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = resp.StatusCode
+	return attempt
+}
+
+// webhookBackoff returns the delay before the next attempt, doubling from
+// webhookBaseBackoff after every failure.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gophermart/internal/models"
+	"gophermart/internal/storage"
+)
+
+func TestSignWebhook(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   string
+	}{
+		{name: "body", secret: "secret", body: `{"event":"order.processed"}`, want: "t=1700000000,v1=72bc88175ee04ab1dc7920d68159ea12673d969c95646f773ea186080944b90b"},
+		{name: "other secret", secret: "other", body: `{"event":"order.processed"}`, want: "t=1700000000,v1=f266ec8dedbd521e0c79c3f81028ef9f742a0905c286bc575f5817aa7698e92a"},
+		{name: "empty body", secret: "secret", body: "", want: "t=1700000000,v1=4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SignWebhook(tt.secret, at, []byte(tt.body)); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// deliveryStorage hands out its deliveries once and records the attempts.
+type deliveryStorage struct {
+	storage.Storage
+	mu         sync.Mutex
+	deliveries []models.WebhookDelivery
+	recorded   map[int64]string
+}
+
+func (s *deliveryStorage) ClaimWebhookDeliveries(_ context.Context, limit int, _ time.Duration) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := min(limit, len(s.deliveries))
+	claimed := s.deliveries[:n]
+	s.deliveries = s.deliveries[n:]
+	return claimed, nil
+}
+
+func (s *deliveryStorage) RecordWebhookAttempt(_ context.Context, deliveryID int64, _ models.WebhookAttempt, status string, _ *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorded[deliveryID] = status
+	return nil
+}
+
+func TestWebhookBatchWithinLease(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if r.Header.Get(WebhookDeliveryHeader) == "3" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	store := &deliveryStorage{recorded: make(map[int64]string)}
+	for i := 1; i <= webhookBatch; i++ {
+		store.deliveries = append(store.deliveries, models.WebhookDelivery{ID: int64(i), URL: srv.URL, Secret: "secret", Payload: []byte("{}")})
+	}
+	d := NewWebhookDispatcher(store, true)
+
+	start := time.Now()
+	n, err := d.dispatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sent one after another, a batch of slow partners would outlast the
+	// lease and be claimed again by another replica.
+	if elapsed := time.Since(start); elapsed >= 4*delay {
+		t.Fatalf("batch took %v, deliveries are not sent in parallel", elapsed)
+	}
+	if webhookLease <= webhookTimeout {
+		t.Fatalf("lease %v does not outlast a request timing out after %v", webhookLease, webhookTimeout)
+	}
+	if n != webhookBatch || len(store.recorded) != webhookBatch {
+		t.Fatalf("sent %d, recorded %d, want %d", n, len(store.recorded), webhookBatch)
+	}
+	if store.recorded[1] != "succeeded" || store.recorded[3] != "pending" {
+		t.Fatalf("recorded %v", store.recorded)
+	}
+}
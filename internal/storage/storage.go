@@ -4,10 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"maps"
+	"math"
+	"slices"
 	"strings"
 	"time"
 
 	"gophermart/internal/models"
+	"gophermart/internal/utils"
+	"gophermart/internal/validation"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
@@ -19,21 +24,89 @@ var (
 	ErrInsufficientFunds = errors.New("insufficient funds")
 	ErrDuplicateWithdrawal = errors.New("duplicate withdrawal")
 	ErrNotFound = errors.New("not found")
+	ErrResetTokenInvalid = errors.New("reset token is invalid or expired")
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+	ErrIdentityLinked = errors.New("identity already linked")
+	ErrEmailTaken = errors.New("email already in use")
+	ErrVerificationTokenInvalid = errors.New("verification token is invalid or expired")
+	ErrSelfTransfer = errors.New("cannot transfer to oneself")
+	ErrTransferLimitExceeded = errors.New("daily transfer limit exceeded")
+	ErrIdempotencyKeyReused = errors.New("idempotency key used for a different transfer")
 )
 
 type Storage interface {
 	InitDB() error
 	CreateUser(ctx context.Context, user *models.User) error
 	GetUserByLogin(ctx context.Context, login string) (*models.User, error)
+	GetUserByID(ctx context.Context, id int) (*models.User, error)
+	GetTokenVersion(ctx context.Context, userID int) (int, error)
+	GetProfile(ctx context.Context, userID int) (*models.Profile, error)
+	UpdateProfile(ctx context.Context, userID int, profile *models.Profile) error
+	DeleteUser(ctx context.Context, userID int) error
+	SetUserRoles(ctx context.Context, userID int, roles []string) error
+	AddUserRole(ctx context.Context, userID int, role string) error
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error)
+	CreateUserWithIdentity(ctx context.Context, user *models.User, issuer, subject string) error
+	LinkIdentity(ctx context.Context, userID int, issuer, subject string) error
+	CreateSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, id string) (*models.Session, error)
+	TouchSession(ctx context.Context, id string) error
+	GetSessions(ctx context.Context, userID int) ([]models.Session, error)
+	RevokeSession(ctx context.Context, userID int, id string) error
+	UpdatePassword(ctx context.Context, userID int, password string) (int, error)
+	CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	ResetPassword(ctx context.Context, tokenHash string, password string) (int, error)
+	CreateEmailVerification(ctx context.Context, userID int, email, tokenHash string, expiresAt time.Time) error
+	VerifyEmail(ctx context.Context, tokenHash string) error
+	SetVerifiedEmail(ctx context.Context, userID int, email string) error
+	CreateOutboxMessage(ctx context.Context, msg *models.OutboxMessage) error
+	GetLoginLock(ctx context.Context, keys ...string) (time.Time, error)
+	AttemptLogin(ctx context.Context, key string, limit int, lockout, maxLockout time.Duration) (bool, error)
+	ReleaseLoginAttempt(ctx context.Context, key string, limit int) error
+	ResetLoginFailures(ctx context.Context, keys ...string) error
+	GetTOTP(ctx context.Context, userID int) (*models.TOTP, error)
+	SetTOTPSecret(ctx context.Context, userID int, secret string) error
+	GetPlainTOTPSecrets(ctx context.Context) (map[int]string, error)
+	ReplaceTOTPSecret(ctx context.Context, userID int, old, secret string) error
+	EnableTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, userID int) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	GetAPIKeys(ctx context.Context, userID int) ([]models.APIKey, error)
+	GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID int, id int) error
+	IncrementAPIKeyUsage(ctx context.Context, keyID int) (int, error)
 	CreateOrder(ctx context.Context, order *models.Order) error
+	CreateOrders(ctx context.Context, orders []models.Order) (map[string]int, error)
 	GetOrderByNumber(ctx context.Context, number string) (*models.Order, error)
 	GetOrders(ctx context.Context, userID int) ([]models.Order, error)
-	UpdateOrder(ctx context.Context, number string, status string, accrual float64) error
+	UpdateOrder(ctx context.Context, number string, status string, accrual float64) (int, bool, error)
 	GetBalance(ctx context.Context, userID int) (*models.Balance, error)
 	ProcessWithdrawal(ctx context.Context, userID int, order string, sum float64) error
 	GetWithdrawals(ctx context.Context, userID int) ([]models.Withdrawal, error)
+	GetOrdersPage(ctx context.Context, userID int, limit, offset int) ([]models.Order, int, error)
+	GetWithdrawalsPage(ctx context.Context, userID int, limit, offset int) ([]models.Withdrawal, int, error)
+	StreamOrders(ctx context.Context, userID int, from, to time.Time, fn func(models.Order) error) error
+	StreamWithdrawals(ctx context.Context, userID int, from, to time.Time, fn func(models.Withdrawal) error) error
+	GetBalanceHistory(ctx context.Context, userID int, filter models.BalanceHistoryFilter, limit, offset int) ([]models.BalanceTransaction, int, error)
+	Transfer(ctx context.Context, transfer *models.Transfer, limits models.TransferLimits) (bool, error)
 	GetPendingOrders(ctx context.Context, limit int) ([]string, error)
+	CreateEvent(ctx context.Context, event *models.Event) error
+	GetEvents(ctx context.Context, userID int, afterID int64, limit int) ([]models.Event, error)
+	GetLastEventID(ctx context.Context, userID int) (int64, error)
+	DeleteEventsBefore(ctx context.Context, before time.Time) error
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	GetWebhooks(ctx context.Context, userID int) ([]models.Webhook, error)
+	DeleteWebhook(ctx context.Context, userID int, id int) error
+	CreateWebhookDeliveries(ctx context.Context, userID int, event string, payload []byte) error
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, deliveryID int64, attempt models.WebhookAttempt, status string, nextAttemptAt *time.Time) error
+	GetWebhookDeliveries(ctx context.Context, userID int, webhookID int, limit int) ([]models.WebhookDelivery, error)
 	SetOrderProcessing(ctx context.Context, orders []string) (map[string]int, error)
+	GetDataVersion(ctx context.Context, userID int) (int64, error)
+	TakeRateLimitToken(ctx context.Context, key string, burst, perSecond float64) (float64, bool, error)
+	DeleteRateLimitsBefore(ctx context.Context, before time.Time) error
 }
 
 type DBStorage struct {
@@ -45,13 +118,61 @@ func NewStorage(db *sql.DB) *DBStorage {
 }
 
 func (s *DBStorage) InitDB() error {
+	// The statements run as one implicit transaction, so the lock keeps
+	// instances starting together from migrating and backfilling at once.
 	_, err := s.DB.Exec(`
+		SELECT pg_advisory_xact_lock(7210431);
+
 		CREATE TABLE IF NOT EXISTS users (
 			id SERIAL PRIMARY KEY,
 			login TEXT UNIQUE NOT NULL,
 			password TEXT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS users_login_idx ON users(login);
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'en';
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS notify_order_updates BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS notify_withdrawals BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS notify_marketing BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS data_version BIGINT NOT NULL DEFAULT 0;
+		CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users(LOWER(email));
+
+		CREATE TABLE IF NOT EXISTS user_roles (
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (user_id, role)
+		);
+
+		CREATE TABLE IF NOT EXISTS user_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			PRIMARY KEY (issuer, subject)
+		);
+		CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities(user_id);
+
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			device TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			revoked_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
 
 		CREATE TABLE IF NOT EXISTS orders (
 			number TEXT PRIMARY KEY,
@@ -75,6 +196,236 @@ func (s *DBStorage) InitDB() error {
 			current FLOAT DEFAULT 0,
 			withdrawn FLOAT DEFAULT 0
 		);
+
+		CREATE TABLE IF NOT EXISTS balance_transactions (
+			id BIGSERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			type TEXT NOT NULL,
+			amount FLOAT NOT NULL,
+			balance FLOAT NOT NULL,
+			order_number TEXT,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS balance_transactions_user_id_idx ON balance_transactions(user_id, created_at, id);
+
+		CREATE TABLE IF NOT EXISTS transfers (
+			id BIGSERIAL PRIMARY KEY,
+			sender_id INTEGER REFERENCES users(id) NOT NULL,
+			recipient_id INTEGER REFERENCES users(id) NOT NULL,
+			amount FLOAT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			UNIQUE (sender_id, idempotency_key)
+		);
+		CREATE INDEX IF NOT EXISTS transfers_sender_id_idx ON transfers(sender_id, created_at);
+		ALTER TABLE balance_transactions ADD COLUMN IF NOT EXISTS transfer_id BIGINT REFERENCES transfers(id);
+
+		-- Balances kept before the history existed are replayed from processed
+		-- orders and withdrawals, the only times known for them. Accruals are
+		-- dated by the upload of their order, since when they were credited
+		-- was not recorded, so they may appear earlier than they arrived.
+		-- Whatever the replay does not explain is recorded as an adjustment.
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM balance_transactions) THEN
+				INSERT INTO balance_transactions (user_id, type, amount, balance, order_number, created_at)
+				SELECT user_id, type, amount,
+					SUM(amount) OVER (PARTITION BY user_id ORDER BY created_at, order_number),
+					order_number, created_at
+				FROM (
+					SELECT user_id, 'accrual' AS type, accrual AS amount, number AS order_number, uploaded_at AS created_at
+					FROM orders WHERE status = 'PROCESSED' AND accrual > 0
+					UNION ALL
+					SELECT user_id, 'withdrawal', -sum, order_number, processed_at FROM withdrawals
+				) t;
+
+				INSERT INTO balance_transactions (user_id, type, amount, balance, created_at)
+				SELECT b.user_id, 'adjustment', b.current - COALESCE(t.sum, 0), b.current, NOW()
+				FROM balances b
+				LEFT JOIN (SELECT user_id, SUM(amount) AS sum FROM balance_transactions GROUP BY user_id) t ON t.user_id = b.user_id
+				WHERE ABS(b.current - COALESCE(t.sum, 0)) >= 0.005;
+			END IF;
+		END $$;
+
+		CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS password_resets_user_id_idx ON password_resets(user_id);
+
+		CREATE TABLE IF NOT EXISTS email_verifications (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			email TEXT NOT NULL,
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS email_verifications_user_id_idx ON email_verifications(user_id);
+
+		CREATE TABLE IF NOT EXISTS outbox (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id),
+			recipient TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			sent_at TIMESTAMP WITH TIME ZONE
+		);
+
+		-- Logins are unique regardless of case and stored NFKC-normalized, as
+		-- they are looked up. Before the index exists, accounts whose login
+		-- clashes with an older one that way get their ID appended and are told
+		-- by email when they have one.
+		DO $$
+		DECLARE
+			r RECORD;
+			candidate TEXT;
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = 'users_login_lower_idx') THEN
+				FOR r IN
+					SELECT id, login, email FROM (
+						SELECT id, login, email, ROW_NUMBER() OVER (
+							PARTITION BY LOWER(normalize(login, NFKC)) ORDER BY id
+						) AS n FROM users
+					) u WHERE n > 1 ORDER BY id
+				LOOP
+					candidate := normalize(r.login, NFKC) || '.' || r.id;
+					WHILE EXISTS (SELECT 1 FROM users WHERE LOWER(normalize(login, NFKC)) = LOWER(candidate)) LOOP
+						candidate := candidate || '.' || r.id;
+					END LOOP;
+					UPDATE users SET login = candidate, data_version = data_version + 1 WHERE id = r.id;
+					UPDATE users SET data_version = data_version + 1
+					WHERE id <> r.id AND id IN (
+						SELECT recipient_id FROM transfers WHERE sender_id = r.id
+						UNION
+						SELECT sender_id FROM transfers WHERE recipient_id = r.id
+					);
+					RAISE NOTICE 'Renamed login of user % to %', r.id, candidate;
+					IF r.email IS NOT NULL THEN
+						INSERT INTO outbox (user_id, recipient, subject, body, created_at)
+						VALUES (r.id, r.email, 'Your login has changed',
+							'Another account already uses your login with different letter case, so your login is now ' || candidate || '.',
+							NOW());
+					END IF;
+				END LOOP;
+			END IF;
+		END $$;
+		CREATE UNIQUE INDEX IF NOT EXISTS users_login_lower_idx ON users(LOWER(login));
+		-- Transfer histories show the login of the other user, so their
+		-- versions change with it.
+		WITH renamed AS (
+			UPDATE users u SET login = normalize(login, NFKC), data_version = data_version + 1
+			WHERE login IS NOT NFKC NORMALIZED
+				AND NOT EXISTS (SELECT 1 FROM users o WHERE o.id <> u.id AND LOWER(o.login) = LOWER(normalize(u.login, NFKC)))
+			RETURNING id
+		)
+		UPDATE users SET data_version = data_version + 1
+		WHERE id NOT IN (SELECT id FROM renamed) AND id IN (
+			SELECT t.recipient_id FROM transfers t JOIN renamed r ON r.id = t.sender_id
+			UNION
+			SELECT t.sender_id FROM transfers t JOIN renamed r ON r.id = t.recipient_id
+		);
+
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			locked_until TIMESTAMP WITH TIME ZONE,
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at TIMESTAMP WITH TIME ZONE,
+			PRIMARY KEY (user_id, code_hash)
+		);
+
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT UNIQUE NOT NULL,
+			key_hash TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			quota_per_day INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			last_used_at TIMESTAMP WITH TIME ZONE,
+			revoked_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys(user_id);
+
+		CREATE TABLE IF NOT EXISTS api_key_usage (
+			key_id INTEGER REFERENCES api_keys(id) NOT NULL,
+			day DATE NOT NULL,
+			requests INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (key_id, day)
+		);
+
+		CREATE TABLE IF NOT EXISTS user_events (
+			id BIGSERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			type TEXT NOT NULL,
+			data JSONB NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS user_events_user_id_idx ON user_events(user_id, id);
+
+		-- Events are numbered per user under a row lock of event_sequences, so
+		-- they become visible in the order of their numbers. Events stored
+		-- before keep their ID as number, which resuming clients still hold.
+		CREATE TABLE IF NOT EXISTS event_sequences (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id),
+			last_seq BIGINT NOT NULL
+		);
+		ALTER TABLE user_events ADD COLUMN IF NOT EXISTS seq BIGINT;
+		UPDATE user_events SET seq = id WHERE seq IS NULL;
+		ALTER TABLE user_events ALTER COLUMN seq SET NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS user_events_user_id_seq_idx ON user_events(user_id, seq);
+		INSERT INTO event_sequences (user_id, last_seq)
+		SELECT user_id, MAX(seq) FROM user_events GROUP BY user_id
+		ON CONFLICT (user_id) DO UPDATE SET last_seq = GREATEST(event_sequences.last_seq, EXCLUDED.last_seq);
+
+		CREATE TABLE IF NOT EXISTS rate_limits (
+			key TEXT PRIMARY KEY,
+			tokens DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			deleted_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks(user_id);
+
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			webhook_id INTEGER REFERENCES webhooks(id) NOT NULL,
+			event TEXT NOT NULL,
+			payload JSONB NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP WITH TIME ZONE,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			delivered_at TIMESTAMP WITH TIME ZONE
+		);
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries(webhook_id, id);
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+		CREATE TABLE IF NOT EXISTS webhook_attempts (
+			delivery_id BIGINT REFERENCES webhook_deliveries(id) NOT NULL,
+			attempted_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			status_code INTEGER,
+			error TEXT,
+			duration_ms BIGINT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_id_idx ON webhook_attempts(delivery_id);
 	`)
 	return err
 }
@@ -97,204 +448,1854 @@ func (s *DBStorage) CreateUser(ctx context.Context, user *models.User) error {
 
 func (s *DBStorage) GetUserByLogin(ctx context.Context, login string) (*models.User, error) {
 	var user models.User
+	var roles string
 	err := s.DB.QueryRowContext(ctx,
-		"SELECT id, login, password FROM users WHERE login = $1",
+		`SELECT id, login, password, token_version, totp_enabled,
+			COALESCE((SELECT string_agg(role, ',' ORDER BY role) FROM user_roles WHERE user_id = users.id), '')
+		 FROM users WHERE LOWER(login) = LOWER($1)`,
 		login,
-	).Scan(&user.ID, &user.Login, &user.Password)
+	).Scan(&user.ID, &user.Login, &user.Password, &user.TokenVersion, &user.TwoFactorEnabled, &roles)
 	
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	return &user, nil
+}
+
+func (s *DBStorage) GetUserByID(ctx context.Context, id int) (*models.User, error) {
+	var user models.User
+	var roles string
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT id, login, password, token_version, totp_enabled,
+			COALESCE((SELECT string_agg(role, ',' ORDER BY role) FROM user_roles WHERE user_id = users.id), '')
+		 FROM users WHERE id = $1`,
+		id,
+	).Scan(&user.ID, &user.Login, &user.Password, &user.TokenVersion, &user.TwoFactorEnabled, &roles)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
 	return &user, nil
 }
 
-func (s *DBStorage) ProcessWithdrawal(ctx context.Context, userID int, order string, sum float64) error {
+func (s *DBStorage) GetTokenVersion(ctx context.Context, userID int) (int, error) {
+	var version int
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT token_version FROM users WHERE id = $1",
+		userID,
+	).Scan(&version)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return version, err
+}
+
+func (s *DBStorage) GetProfile(ctx context.Context, userID int) (*models.Profile, error) {
+	var p models.Profile
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT login, display_name, COALESCE(email, ''), email_verified, COALESCE(phone, ''), locale,
+			notify_order_updates, notify_withdrawals, notify_marketing, created_at
+		 FROM users WHERE id = $1`,
+		userID,
+	).Scan(&p.Login, &p.DisplayName, &p.Email, &p.EmailVerified, &p.Phone, &p.Locale,
+		&p.Notifications.OrderUpdates, &p.Notifications.Withdrawals, &p.Notifications.Marketing, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdateProfile stores the editable profile fields. A changed email address
+// loses its verified status.
+func (s *DBStorage) UpdateProfile(ctx context.Context, userID int, profile *models.Profile) error {
+	err := s.DB.QueryRowContext(ctx,
+		`UPDATE users SET
+			display_name = $2,
+			email_verified = email_verified AND LOWER(email) IS NOT DISTINCT FROM LOWER(NULLIF($3, '')),
+			email = NULLIF($3, ''),
+			phone = NULLIF($4, ''),
+			locale = $5,
+			notify_order_updates = $6,
+			notify_withdrawals = $7,
+			notify_marketing = $8
+		 WHERE id = $1
+		 RETURNING email_verified`,
+		userID, profile.DisplayName, profile.Email, profile.Phone, profile.Locale,
+		profile.Notifications.OrderUpdates, profile.Notifications.Withdrawals, profile.Notifications.Marketing,
+	).Scan(&profile.EmailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil && strings.Contains(err.Error(), "duplicate key") {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// DeleteUser erases the personal data of a user. The user row is kept under an
+// anonymous login together with orders, withdrawals and the balance, which are
+// needed for accounting. Credentials are removed, every session and API key is
+// revoked, and pending webhook deliveries are cancelled.
+func (s *DBStorage) DeleteUser(ctx context.Context, userID int) error {
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	var current float64
+	var login string
 	err = tx.QueryRowContext(ctx,
-		"SELECT current FROM balances WHERE user_id = $1 FOR UPDATE",
+		"SELECT login FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE",
 		userID,
-	).Scan(&current)
-
-	if err == sql.ErrNoRows {
-		if _, err = tx.ExecContext(ctx,
-			"INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, 0, 0)",
-			userID,
-		); err != nil {
-			return err
-		}
-		current = 0
+	).Scan(&login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
 	} else if err != nil {
 		return err
 	}
 
-	if current < sum {
-		return ErrInsufficientFunds
-	}
-
+	// The colon is not allowed in logins, so the anonymous login can never
+	// collide with a registered one.
 	if _, err = tx.ExecContext(ctx,
-		"INSERT INTO withdrawals (order_number, sum, processed_at, user_id) VALUES ($1, $2, $3, $4)",
-		order, sum, time.Now(), userID,
+		`UPDATE users SET
+			login = 'deleted:' || id,
+			password = '!',
+			token_version = token_version + 1,
+			totp_secret = NULL,
+			totp_enabled = FALSE,
+			display_name = '',
+			email = NULL,
+			email_verified = FALSE,
+			phone = NULL,
+			deleted_at = NOW()
+		 WHERE id = $1`,
+		userID,
 	); err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
-			return ErrDuplicateWithdrawal
-		}
 		return err
 	}
 
-	if _, err = tx.ExecContext(ctx,
-		"UPDATE balances SET current = current - $1, withdrawn = withdrawn + $2 WHERE user_id = $3",
-		sum, sum, userID,
-	); err != nil {
-		return err
+	for _, query := range []string{
+		"DELETE FROM user_roles WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM recovery_codes WHERE user_id = $1",
+		"DELETE FROM password_resets WHERE user_id = $1",
+		"DELETE FROM email_verifications WHERE user_id = $1",
+		"DELETE FROM outbox WHERE user_id = $1",
+		"DELETE FROM user_events WHERE user_id = $1",
+		`UPDATE webhook_deliveries SET
+			payload = '{}',
+			status = CASE WHEN status = 'pending' THEN 'cancelled' ELSE status END,
+			next_attempt_at = NULL
+		 WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = $1)`,
+		`UPDATE webhook_attempts SET error = NULL
+		 WHERE delivery_id IN (SELECT d.id FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE w.user_id = $1)`,
+		"UPDATE webhooks SET deleted_at = NOW(), url = '', secret = '' WHERE user_id = $1 AND deleted_at IS NULL",
+		`UPDATE sessions SET revoked_at = COALESCE(revoked_at, NOW()), ip = '', user_agent = '', device = ''
+		 WHERE user_id = $1`,
+		"UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+	} {
+		if _, err = tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
 	}
 
-	return tx.Commit()
-}
+	// Failed logins are kept by login, which is personal data as well.
+	if _, err = tx.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = $1", "login:"+login); err != nil {
+		return err
+	}
 
-func (s *DBStorage) CreateOrder(ctx context.Context, order *models.Order) error {
-	_, err := s.DB.ExecContext(ctx,
-		"INSERT INTO orders (number, status, uploaded_at, user_id) VALUES ($1, $2, $3, $4)",
-		order.Number, order.Status, order.UploadedAt, order.UserID,
-	)
-	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
-			return ErrOrderExists
-		}
+	// The anonymous login shows up in the transfer histories of the other
+	// users.
+	if err = bumpCounterparties(ctx, tx, userID); err != nil {
 		return err
 	}
-	return nil
+
+	return tx.Commit()
 }
 
-func (s *DBStorage) GetOrderByNumber(ctx context.Context, number string) (*models.Order, error) {
-	var order models.Order
+func (s *DBStorage) GetUserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	var userID int
 	err := s.DB.QueryRowContext(ctx,
-		"SELECT number, status, accrual, uploaded_at, user_id FROM orders WHERE number = $1",
-		number,
-	).Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt, &order.UserID)
-	
+		"SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2",
+		issuer, subject,
+	).Scan(&userID)
+
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrOrderNotFound
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-	return &order, nil
+	return s.GetUserByID(ctx, userID)
 }
 
-func (s *DBStorage) GetOrders(ctx context.Context, userID int) ([]models.Order, error) {
-	rows, err := s.DB.QueryContext(ctx,
-		"SELECT number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC",
-		userID,
-	)
+// CreateUserWithIdentity registers a user signing in through an identity
+// provider for the first time.
+func (s *DBStorage) CreateUserWithIdentity(ctx context.Context, user *models.User, issuer, subject string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var orders []models.Order
-	for rows.Next() {
-		var order models.Order
-		if err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
-			return nil, err
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO users (login, password) VALUES ($1, $2) RETURNING id",
+		user.Login, user.Password,
+	).Scan(&user.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return ErrUserExists
 		}
-		orders = append(orders, order)
+		return err
 	}
-	return orders, rows.Err()
+
+	if _, err = tx.ExecContext(ctx,
+		"INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)",
+		issuer, subject, user.ID, time.Now(),
+	); err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return ErrIdentityLinked
+		}
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (s *DBStorage) UpdateOrder(ctx context.Context, number string, status string, accrual float64) error {
+func (s *DBStorage) LinkIdentity(ctx context.Context, userID int, issuer, subject string) error {
 	_, err := s.DB.ExecContext(ctx,
-		"UPDATE orders SET status = $1, accrual = $2 WHERE number = $3",
-		status, accrual, number,
+		"INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)",
+		issuer, subject, userID, time.Now(),
 	)
+	if err != nil && strings.Contains(err.Error(), "duplicate key") {
+		return ErrIdentityLinked
+	}
 	return err
 }
 
-func (s *DBStorage) GetBalance(ctx context.Context, userID int) (*models.Balance, error) {
-	var balance models.Balance
-	err := s.DB.QueryRowContext(ctx,
-		"SELECT current, withdrawn FROM balances WHERE user_id = $1",
-		userID,
-	).Scan(&balance.Current, &balance.Withdrawn)
-
-	if errors.Is(err, sql.ErrNoRows) {
-		return &models.Balance{Current: 0, Withdrawn: 0}, nil
+// SetUserRoles replaces the roles of the user. The token version is bumped so
+// that tokens carrying the old roles stop working.
+func (s *DBStorage) SetUserRoles(ctx context.Context, userID int, roles []string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return &balance, err
-}
+	defer tx.Rollback()
 
-func (s *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]models.Withdrawal, error) {
-	rows, err := s.DB.QueryContext(ctx,
-		"SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id = $1 ORDER BY processed_at DESC",
+	res, err := tx.ExecContext(ctx,
+		"UPDATE users SET token_version = token_version + 1 WHERE id = $1",
 		userID,
 	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
 	}
-	defer rows.Close()
 
-	var withdrawals []models.Withdrawal
-	for rows.Next() {
-		var w models.Withdrawal
-		if err := rows.Scan(&w.Order, &w.Sum, &w.ProcessedAt); err != nil {
-			return nil, err
+	if _, err = tx.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if _, err = tx.ExecContext(ctx,
+			"INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			userID, role,
+		); err != nil {
+			return err
 		}
-		withdrawals = append(withdrawals, w)
 	}
-	return withdrawals, rows.Err()
+
+	return tx.Commit()
 }
 
-func (s *DBStorage) GetPendingOrders(ctx context.Context, limit int) ([]string, error) {
-	rows, err := s.DB.QueryContext(ctx,
-		"SELECT number FROM orders WHERE status IN ('NEW', 'PROCESSING') ORDER BY uploaded_at LIMIT $1",
-		limit,
+func (s *DBStorage) AddUserRole(ctx context.Context, userID int, role string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, role,
 	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return tx.Commit()
 	}
-	defer rows.Close()
 
-	var orders []string
-	for rows.Next() {
-		var number string
-		if err := rows.Scan(&number); err != nil {
-			return nil, err
-		}
-		orders = append(orders, number)
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE users SET token_version = token_version + 1 WHERE id = $1",
+		userID,
+	); err != nil {
+		return err
 	}
-	return orders, rows.Err()
+
+	return tx.Commit()
 }
 
-func (s *DBStorage) SetOrderProcessing(ctx context.Context, orders []string) (map[string]int, error) {
+// UpdatePassword stores the new password hash, bumps the token version and
+// revokes all sessions, which invalidates every token issued before the change.
+// It returns the new version.
+func (s *DBStorage) UpdatePassword(ctx context.Context, userID int, password string) (int, error) {
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(ctx,
-		"UPDATE orders SET status = 'PROCESSING' WHERE number = $1 AND status = 'NEW' RETURNING user_id")
-	if err != nil {
-		return nil, err
+	var version int
+	err = tx.QueryRowContext(ctx,
+		"UPDATE users SET password = $1, token_version = token_version + 1 WHERE id = $2 RETURNING token_version",
+		password, userID,
+	).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
 	}
-	defer stmt.Close()
 
-	userIDs := make(map[string]int)
-	for _, number := range orders {
-		var userID int
-		if err := stmt.QueryRowContext(ctx, number).Scan(&userID); err == nil {
-			userIDs[number] = userID
-		}
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID,
+	); err != nil {
+		return 0, err
+	}
+
+	return version, tx.Commit()
+}
+
+func (s *DBStorage) CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := s.DB.ExecContext(ctx,
+		"INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		tokenHash, userID, expiresAt,
+	)
+	return err
+}
+
+// ResetPassword consumes a reset token and sets the new password in one
+// transaction. Every other outstanding token of the user is consumed as well.
+func (s *DBStorage) ResetPassword(ctx context.Context, tokenHash string, password string) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		`UPDATE password_resets SET used_at = NOW()
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id`,
+		tokenHash,
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrResetTokenInvalid
+	} else if err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE users SET password = $1, token_version = token_version + 1 WHERE id = $2",
+		password, userID,
+	); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID,
+	); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+func (s *DBStorage) CreateEmailVerification(ctx context.Context, userID int, email, tokenHash string, expiresAt time.Time) error {
+	_, err := s.DB.ExecContext(ctx,
+		"INSERT INTO email_verifications (token_hash, user_id, email, expires_at) VALUES ($1, $2, $3, $4)",
+		tokenHash, userID, email, expiresAt,
+	)
+	return err
+}
+
+// VerifyEmail consumes a verification token and marks the address it was sent
+// to as verified, unless the user has changed their email since.
+func (s *DBStorage) VerifyEmail(ctx context.Context, tokenHash string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	err = tx.QueryRowContext(ctx,
+		`UPDATE email_verifications SET used_at = NOW()
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id, email`,
+		tokenHash,
+	).Scan(&userID, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrVerificationTokenInvalid
+	} else if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE users SET email_verified = TRUE WHERE id = $1 AND LOWER(email) = LOWER($2) AND deleted_at IS NULL",
+		userID, email,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrVerificationTokenInvalid
+	}
+
+	return tx.Commit()
+}
+
+// SetVerifiedEmail records an address verified elsewhere, like by an identity
+// provider. It does not replace a different address the user has set.
+func (s *DBStorage) SetVerifiedEmail(ctx context.Context, userID int, email string) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET email = $2, email_verified = TRUE
+		 WHERE id = $1 AND (email IS NULL OR LOWER(email) = LOWER($2))`,
+		userID, email,
+	)
+	if err != nil && strings.Contains(err.Error(), "duplicate key") {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (s *DBStorage) CreateOutboxMessage(ctx context.Context, msg *models.OutboxMessage) error {
+	return s.DB.QueryRowContext(ctx,
+		"INSERT INTO outbox (user_id, recipient, subject, body, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		msg.UserID, msg.Recipient, msg.Subject, msg.Body, msg.CreatedAt,
+	).Scan(&msg.ID)
+}
+
+// GetLoginLock returns the latest lockout deadline among the given keys, or the
+// zero time if none of them is locked.
+func (s *DBStorage) GetLoginLock(ctx context.Context, keys ...string) (time.Time, error) {
+	if len(keys) == 0 {
+		return time.Time{}, nil
+	}
+	inClause, args := utils.BuildInClause(keys, 1)
+
+	var lockedUntil sql.NullTime
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT MAX(locked_until) FROM login_attempts WHERE key IN ("+inClause+") AND locked_until > NOW()",
+		args...,
+	).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// AttemptLogin counts an attempt for the key as failed before it is checked
+// and reports whether it may go ahead. Attempts are refused while the key is
+// locked; the attempt that reaches limit locks it for lockout, doubled for
+// every further failure up to maxLockout. Failures older than maxLockout are
+// forgotten. The row lock taken by the upsert serializes concurrent attempts.
+func (s *DBStorage) AttemptLogin(ctx context.Context, key string, limit int, lockout, maxLockout time.Duration) (bool, error) {
+	var failures int
+	err := s.DB.QueryRowContext(ctx,
+		`INSERT INTO login_attempts (key, failures, locked_until, updated_at)
+		 VALUES ($1, 1, CASE WHEN $2 <= 1 THEN NOW() + make_interval(secs => $3) END, NOW())
+		 ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.updated_at < NOW() - make_interval(secs => $4) THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			locked_until = CASE
+				WHEN login_attempts.updated_at < NOW() - make_interval(secs => $4) THEN
+					CASE WHEN $2 <= 1 THEN NOW() + make_interval(secs => $3) END
+				WHEN login_attempts.failures + 1 >= $2 THEN
+					NOW() + make_interval(secs => LEAST($3 * power(2, LEAST(login_attempts.failures + 1 - $2, 30)), $4))
+			END,
+			updated_at = NOW()
+		 WHERE login_attempts.locked_until IS NULL OR login_attempts.locked_until <= NOW()
+		 RETURNING failures`,
+		key, limit, lockout.Seconds(), maxLockout.Seconds(),
+	).Scan(&failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseLoginAttempt takes back an attempt counted by AttemptLogin that
+// turned out to be right, lifting the lock if it set one.
+func (s *DBStorage) ReleaseLoginAttempt(ctx context.Context, key string, limit int) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE login_attempts SET
+			failures = GREATEST(failures - 1, 0),
+			locked_until = CASE WHEN failures - 1 < $2 THEN NULL ELSE locked_until END
+		 WHERE key = $1`,
+		key, limit,
+	)
+	return err
+}
+
+func (s *DBStorage) ResetLoginFailures(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	inClause, args := utils.BuildInClause(keys, 1)
+	_, err := s.DB.ExecContext(ctx,
+		"DELETE FROM login_attempts WHERE key IN ("+inClause+")",
+		args...,
+	)
+	return err
+}
+
+func (s *DBStorage) GetTOTP(ctx context.Context, userID int) (*models.TOTP, error) {
+	var totp models.TOTP
+	var secret sql.NullString
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1",
+		userID,
+	).Scan(&secret, &totp.Enabled, &totp.LastStep)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	totp.Secret = secret.String
+	return &totp, nil
+}
+
+// SetTOTPSecret stores a secret that is pending confirmation. It never replaces
+// the secret of an enabled second factor.
+func (s *DBStorage) SetTOTPSecret(ctx context.Context, userID int, secret string) error {
+	res, err := s.DB.ExecContext(ctx,
+		"UPDATE users SET totp_secret = $1 WHERE id = $2 AND NOT totp_enabled",
+		secret, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// GetPlainTOTPSecrets returns the secrets stored before they were encrypted,
+// by user ID.
+func (s *DBStorage) GetPlainTOTPSecrets(ctx context.Context) (map[int]string, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL AND totp_secret NOT LIKE 'enc:%'",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			return nil, err
+		}
+		secrets[id] = secret
+	}
+	return secrets, rows.Err()
+}
+
+// ReplaceTOTPSecret swaps the stored secret for another encoding of it, unless
+// it has changed in the meantime.
+func (s *DBStorage) ReplaceTOTPSecret(ctx context.Context, userID int, old, secret string) error {
+	_, err := s.DB.ExecContext(ctx,
+		"UPDATE users SET totp_secret = $1 WHERE id = $2 AND totp_secret = $3",
+		secret, userID, old,
+	)
+	return err
+}
+
+// EnableTOTP turns the pending secret on, marks the confirming step as used and
+// replaces the recovery codes.
+func (s *DBStorage) EnableTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET totp_enabled = TRUE, totp_last_step = $1
+		 WHERE id = $2 AND NOT totp_enabled AND totp_secret IS NOT NULL`,
+		step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.ExecContext(ctx,
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *DBStorage) DisableTOTP(ctx context.Context, userID int) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE id = $1",
+		userID,
+	); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code. It reports false if the
+// step, or a later one, was already used, so a code cannot be replayed.
+func (s *DBStorage) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	res, err := s.DB.ExecContext(ctx,
+		"UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1",
+		step, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *DBStorage) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx,
+		"UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *DBStorage) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	return s.DB.QueryRowContext(ctx,
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, quota_per_day, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		key.UserID, key.Name, key.Prefix, key.Hash, strings.Join(key.Scopes, ","), key.QuotaPerDay, key.CreatedAt,
+	).Scan(&key.ID)
+}
+
+func (s *DBStorage) GetAPIKeys(ctx context.Context, userID int) ([]models.APIKey, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, user_id, name, prefix, key_hash, scopes, quota_per_day, created_at, last_used_at, revoked_at
+		 FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *DBStorage) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	key, err := scanAPIKey(s.DB.QueryRowContext(ctx,
+		`SELECT id, user_id, name, prefix, key_hash, scopes, quota_per_day, created_at, last_used_at, revoked_at
+		 FROM api_keys WHERE prefix = $1`,
+		prefix,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (*models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Hash, &scopes,
+		&key.QuotaPerDay, &key.CreatedAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return &key, nil
+}
+
+func (s *DBStorage) RevokeAPIKey(ctx context.Context, userID int, id int) error {
+	res, err := s.DB.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// IncrementAPIKeyUsage counts a request made with the key on the current UTC day
+// and returns the number of requests made that day so far.
+func (s *DBStorage) IncrementAPIKeyUsage(ctx context.Context, keyID int) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var requests int
+	if err = tx.QueryRowContext(ctx,
+		`INSERT INTO api_key_usage (key_id, day, requests)
+		 VALUES ($1, (NOW() AT TIME ZONE 'UTC')::date, 1)
+		 ON CONFLICT (key_id, day) DO UPDATE SET requests = api_key_usage.requests + 1
+		 RETURNING requests`,
+		keyID,
+	).Scan(&requests); err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE api_keys SET last_used_at = NOW() WHERE id = $1",
+		keyID,
+	); err != nil {
+		return 0, err
+	}
+
+	return requests, tx.Commit()
+}
+
+func (s *DBStorage) CreateSession(ctx context.Context, session *models.Session) error {
+	_, err := s.DB.ExecContext(ctx,
+		`INSERT INTO sessions (id, user_id, device, ip, user_agent, created_at, last_seen_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		session.ID, session.UserID, session.Device, session.IP, session.UserAgent,
+		session.CreatedAt, session.LastSeenAt, session.ExpiresAt,
+	)
+	return err
+}
+
+func (s *DBStorage) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	session, err := scanSession(s.DB.QueryRowContext(ctx,
+		`SELECT id, user_id, device, ip, user_agent, created_at, last_seen_at, expires_at, revoked_at IS NOT NULL
+		 FROM sessions WHERE id = $1`,
+		id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *DBStorage) TouchSession(ctx context.Context, id string) error {
+	_, err := s.DB.ExecContext(ctx,
+		"UPDATE sessions SET last_seen_at = NOW() WHERE id = $1",
+		id,
+	)
+	return err
+}
+
+// GetSessions lists the sessions of the user that are neither revoked nor expired.
+func (s *DBStorage) GetSessions(ctx context.Context, userID int) ([]models.Session, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, user_id, device, ip, user_agent, created_at, last_seen_at, expires_at, revoked_at IS NOT NULL
+		 FROM sessions
+		 WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		 ORDER BY last_seen_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+func scanSession(row interface{ Scan(dest ...any) error }) (*models.Session, error) {
+	var session models.Session
+	if err := row.Scan(&session.ID, &session.UserID, &session.Device, &session.IP, &session.UserAgent,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.Revoked); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *DBStorage) RevokeSession(ctx context.Context, userID int, id string) error {
+	res, err := s.DB.ExecContext(ctx,
+		"UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *DBStorage) ProcessWithdrawal(ctx context.Context, userID int, order string, sum float64) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current float64
+	err = tx.QueryRowContext(ctx,
+		"SELECT current FROM balances WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&current)
+
+	if err == sql.ErrNoRows {
+		if _, err = tx.ExecContext(ctx,
+			"INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, 0, 0)",
+			userID,
+		); err != nil {
+			return err
+		}
+		current = 0
+	} else if err != nil {
+		return err
+	}
+
+	if current < sum {
+		return ErrInsufficientFunds
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"INSERT INTO withdrawals (order_number, sum, processed_at, user_id) VALUES ($1, $2, $3, $4)",
+		order, sum, time.Now(), userID,
+	); err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return ErrDuplicateWithdrawal
+		}
+		return err
+	}
+
+	if err = tx.QueryRowContext(ctx,
+		"UPDATE balances SET current = current - $1, withdrawn = withdrawn + $2 WHERE user_id = $3 RETURNING current",
+		sum, sum, userID,
+	).Scan(&current); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		`INSERT INTO balance_transactions (user_id, type, amount, balance, order_number, created_at)
+		 VALUES ($1, $2, $3, $4, $5, NOW())`,
+		userID, models.TransactionWithdrawal, -sum, current, order,
+	); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, bumpDataVersion, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *DBStorage) CreateOrder(ctx context.Context, order *models.Order) error {
+	_, err := s.DB.ExecContext(ctx,
+		`WITH o AS (
+			INSERT INTO orders (number, status, uploaded_at, user_id) VALUES ($1, $2, $3, $4)
+			RETURNING user_id
+		)
+		UPDATE users SET data_version = data_version + 1 WHERE id IN (SELECT user_id FROM o)`,
+		order.Number, order.Status, order.UploadedAt, order.UserID,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return ErrOrderExists
+		}
+		return err
+	}
+	return nil
+}
+
+// CreateOrders inserts the orders in one transaction, skipping numbers that are
+// already uploaded. It returns the owner of every skipped number.
+func (s *DBStorage) CreateOrders(ctx context.Context, orders []models.Order) (map[string]int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareContext(ctx,
+		`INSERT INTO orders (number, status, uploaded_at, user_id) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (number) DO NOTHING`)
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+
+	owner, err := tx.PrepareContext(ctx, "SELECT user_id FROM orders WHERE number = $1")
+	if err != nil {
+		return nil, err
+	}
+	defer owner.Close()
+
+	existing := make(map[string]int)
+	changed := make(map[int]bool)
+	for _, order := range orders {
+		res, err := insert.ExecContext(ctx, order.Number, order.Status, order.UploadedAt, order.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			changed[order.UserID] = true
+			continue
+		}
+
+		var userID int
+		if err := owner.QueryRowContext(ctx, order.Number).Scan(&userID); err != nil {
+			return nil, err
+		}
+		existing[order.Number] = userID
+	}
+
+	if err := bumpDataVersions(ctx, tx, changed); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (s *DBStorage) GetOrderByNumber(ctx context.Context, number string) (*models.Order, error) {
+	var order models.Order
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT number, status, accrual, uploaded_at, user_id FROM orders WHERE number = $1",
+		number,
+	).Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt, &order.UserID)
+	
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (s *DBStorage) GetOrders(ctx context.Context, userID int) ([]models.Order, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		var order models.Order
+		if err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// UpdateOrder sets the status and accrual of the order and returns the ID of
+// its owner. It reports whether anything changed, so that an order the accrual
+// system keeps answering the same for is not announced again. An order that
+// becomes PROCESSED credits its accrual to the owner's balance, with an entry
+// in the balance history, in the same transaction.
+func (s *DBStorage) UpdateOrder(ctx context.Context, number string, status string, accrual float64) (int, bool, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var oldStatus string
+	var oldAccrual float64
+	err = tx.QueryRowContext(ctx,
+		"SELECT user_id, status, COALESCE(accrual, 0) FROM orders WHERE number = $1 FOR UPDATE",
+		number,
+	).Scan(&userID, &oldStatus, &oldAccrual)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, ErrOrderNotFound
+	} else if err != nil {
+		return 0, false, err
+	}
+	if oldStatus == status && oldAccrual == accrual {
+		return userID, false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE orders SET status = $1, accrual = $2 WHERE number = $3",
+		status, accrual, number,
+	); err != nil {
+		return 0, false, err
+	}
+	if status == "PROCESSED" && oldStatus != "PROCESSED" && accrual > 0 {
+		var current float64
+		if err = tx.QueryRowContext(ctx,
+			`INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, 0)
+			 ON CONFLICT (user_id) DO UPDATE SET current = balances.current + EXCLUDED.current
+			 RETURNING current`,
+			userID, accrual,
+		).Scan(&current); err != nil {
+			return 0, false, err
+		}
+		if _, err = tx.ExecContext(ctx,
+			`INSERT INTO balance_transactions (user_id, type, amount, balance, order_number, created_at)
+			 VALUES ($1, $2, $3, $4, $5, NOW())`,
+			userID, models.TransactionAccrual, accrual, current, number,
+		); err != nil {
+			return 0, false, err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, bumpDataVersion, userID); err != nil {
+		return 0, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return userID, true, nil
+}
+
+func (s *DBStorage) GetBalance(ctx context.Context, userID int) (*models.Balance, error) {
+	var balance models.Balance
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT current, withdrawn FROM balances WHERE user_id = $1",
+		userID,
+	).Scan(&balance.Current, &balance.Withdrawn)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &models.Balance{Current: 0, Withdrawn: 0}, nil
+	}
+	return &balance, err
+}
+
+func (s *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]models.Withdrawal, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id = $1 ORDER BY processed_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var withdrawals []models.Withdrawal
+	for rows.Next() {
+		var w models.Withdrawal
+		if err := rows.Scan(&w.Order, &w.Sum, &w.ProcessedAt); err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, w)
+	}
+	return withdrawals, rows.Err()
+}
+
+// GetOrdersPage returns a page of the user's orders, newest first, and the
+// total number of orders.
+func (s *DBStorage) GetOrdersPage(ctx context.Context, userID int, limit, offset int) ([]models.Order, int, error) {
+	var total int
+	if err := s.DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM orders WHERE user_id = $1",
+		userID,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT number, status, accrual, uploaded_at FROM orders WHERE user_id = $1
+		 ORDER BY uploaded_at DESC, number LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	orders := []models.Order{}
+	for rows.Next() {
+		order := models.Order{UserID: userID}
+		if err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
+			return nil, 0, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, total, rows.Err()
+}
+
+// GetWithdrawalsPage returns a page of the user's withdrawals, newest first,
+// and the total number of withdrawals.
+func (s *DBStorage) GetWithdrawalsPage(ctx context.Context, userID int, limit, offset int) ([]models.Withdrawal, int, error) {
+	var total int
+	if err := s.DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM withdrawals WHERE user_id = $1",
+		userID,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id = $1
+		 ORDER BY processed_at DESC, order_number LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	withdrawals := []models.Withdrawal{}
+	for rows.Next() {
+		w := models.Withdrawal{UserID: userID}
+		if err := rows.Scan(&w.Order, &w.Sum, &w.ProcessedAt); err != nil {
+			return nil, 0, err
+		}
+		withdrawals = append(withdrawals, w)
+	}
+	return withdrawals, total, rows.Err()
+}
+
+// StreamOrders calls fn for every order of the user uploaded in [from, to),
+// oldest first, without loading them all into memory. A zero bound is open.
+// An error returned by fn stops the iteration and is returned.
+func (s *DBStorage) StreamOrders(ctx context.Context, userID int, from, to time.Time, fn func(models.Order) error) error {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT number, status, accrual, uploaded_at FROM orders
+		 WHERE user_id = $1 AND ($2::timestamptz IS NULL OR uploaded_at >= $2)
+		 AND ($3::timestamptz IS NULL OR uploaded_at < $3)
+		 ORDER BY uploaded_at, number`,
+		userID, nullTime(from), nullTime(to),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		order := models.Order{UserID: userID}
+		if err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StreamWithdrawals is StreamOrders for withdrawals.
+func (s *DBStorage) StreamWithdrawals(ctx context.Context, userID int, from, to time.Time, fn func(models.Withdrawal) error) error {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT order_number, sum, processed_at FROM withdrawals
+		 WHERE user_id = $1 AND ($2::timestamptz IS NULL OR processed_at >= $2)
+		 AND ($3::timestamptz IS NULL OR processed_at < $3)
+		 ORDER BY processed_at, order_number`,
+		userID, nullTime(from), nullTime(to),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		w := models.Withdrawal{UserID: userID}
+		if err := rows.Scan(&w.Order, &w.Sum, &w.ProcessedAt); err != nil {
+			return err
+		}
+		if err := fn(w); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Transfer moves the amount from the sender to the user with the recipient
+// login and records it in both histories. Both balances are locked in user ID
+// order, so concurrent transfers between the same users cannot deadlock. A
+// transfer repeating the sender's idempotency key is not executed again:
+// Transfer fills in the earlier one and returns false, or ErrIdempotencyKeyReused
+// if it went to someone else or was for another amount.
+func (s *DBStorage) Transfer(ctx context.Context, transfer *models.Transfer, limits models.TransferLimits) (bool, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE LOWER(login) = LOWER($1) AND deleted_at IS NULL",
+		validation.NormalizeLogin(transfer.Recipient),
+	).Scan(&transfer.RecipientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNotFound
+	} else if err != nil {
+		return false, err
+	}
+	if transfer.RecipientID == transfer.SenderID {
+		return false, ErrSelfTransfer
+	}
+
+	ids := []int{transfer.SenderID, transfer.RecipientID}
+	if ids[0] > ids[1] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	balances := make(map[int]float64)
+	for _, id := range ids {
+		if _, err = tx.ExecContext(ctx,
+			"INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, 0, 0) ON CONFLICT (user_id) DO NOTHING",
+			id,
+		); err != nil {
+			return false, err
+		}
+		var current float64
+		if err = tx.QueryRowContext(ctx,
+			"SELECT current FROM balances WHERE user_id = $1 FOR UPDATE",
+			id,
+		).Scan(&current); err != nil {
+			return false, err
+		}
+		balances[id] = current
+	}
+
+	// The sender's balance is locked, so none of their other transfers can
+	// run between these checks and the insert.
+	var previous models.Transfer
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, recipient_id, amount, created_at FROM transfers WHERE sender_id = $1 AND idempotency_key = $2",
+		transfer.SenderID, transfer.IdempotencyKey,
+	).Scan(&previous.ID, &previous.RecipientID, &previous.Amount, &previous.CreatedAt)
+	if err == nil {
+		if previous.RecipientID != transfer.RecipientID || math.Abs(previous.Amount-transfer.Amount) >= 0.005 {
+			return false, ErrIdempotencyKeyReused
+		}
+		transfer.ID, transfer.CreatedAt = previous.ID, previous.CreatedAt
+		return false, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	var sentSum float64
+	var sentCount int
+	if err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM transfers
+		 WHERE sender_id = $1 AND created_at >= date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'`,
+		transfer.SenderID,
+	).Scan(&sentSum, &sentCount); err != nil {
+		return false, err
+	}
+	if limits.DailyCount > 0 && sentCount >= limits.DailyCount ||
+		limits.DailySum > 0 && math.Round((sentSum+transfer.Amount)*100) > math.Round(limits.DailySum*100) {
+		return false, ErrTransferLimitExceeded
+	}
+
+	if balances[transfer.SenderID] < transfer.Amount {
+		return false, ErrInsufficientFunds
+	}
+
+	if err = tx.QueryRowContext(ctx,
+		`INSERT INTO transfers (sender_id, recipient_id, amount, idempotency_key, created_at)
+		 VALUES ($1, $2, $3, $4, NOW()) RETURNING id, created_at`,
+		transfer.SenderID, transfer.RecipientID, transfer.Amount, transfer.IdempotencyKey,
+	).Scan(&transfer.ID, &transfer.CreatedAt); err != nil {
+		return false, err
+	}
+
+	for _, entry := range []struct {
+		userID int
+		typ    string
+		amount float64
+	}{
+		{transfer.SenderID, models.TransactionTransferOut, -transfer.Amount},
+		{transfer.RecipientID, models.TransactionTransferIn, transfer.Amount},
+	} {
+		var current float64
+		if err = tx.QueryRowContext(ctx,
+			"UPDATE balances SET current = current + $1 WHERE user_id = $2 RETURNING current",
+			entry.amount, entry.userID,
+		).Scan(&current); err != nil {
+			return false, err
+		}
+		if _, err = tx.ExecContext(ctx,
+			`INSERT INTO balance_transactions (user_id, type, amount, balance, transfer_id, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6)`,
+			entry.userID, entry.typ, entry.amount, current, transfer.ID, transfer.CreatedAt,
+		); err != nil {
+			return false, err
+		}
+	}
+	if err = bumpDataVersions(ctx, tx, map[int]bool{transfer.SenderID: true, transfer.RecipientID: true}); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetBalanceHistory returns a page of the user's balance transactions matching
+// the filter, newest first, and the total number of matching transactions.
+func (s *DBStorage) GetBalanceHistory(ctx context.Context, userID int, filter models.BalanceHistoryFilter, limit, offset int) ([]models.BalanceTransaction, int, error) {
+	where := `WHERE t.user_id = $1 AND ($2 = '' OR t.type = ANY(string_to_array($2, ',')))
+		 AND ($3::timestamptz IS NULL OR t.created_at >= $3)
+		 AND ($4::timestamptz IS NULL OR t.created_at < $4)`
+	types := strings.Join(filter.Types, ",")
+
+	var total int
+	if err := s.DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM balance_transactions t "+where,
+		userID, types, nullTime(filter.From), nullTime(filter.To),
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT t.id, t.type, t.amount, t.balance, COALESCE(t.order_number, ''), COALESCE(u.login, ''), t.created_at
+		 FROM balance_transactions t
+		 LEFT JOIN transfers tr ON tr.id = t.transfer_id
+		 LEFT JOIN users u ON u.id = CASE WHEN tr.sender_id = t.user_id THEN tr.recipient_id ELSE tr.sender_id END
+		 `+where+`
+		 ORDER BY t.created_at DESC, t.id DESC LIMIT $5 OFFSET $6`,
+		userID, types, nullTime(filter.From), nullTime(filter.To), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	transactions := []models.BalanceTransaction{}
+	for rows.Next() {
+		t := models.BalanceTransaction{UserID: userID}
+		if err := rows.Scan(&t.ID, &t.Type, &t.Amount, &t.Balance, &t.Order, &t.Counterparty, &t.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, total, rows.Err()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (s *DBStorage) GetPendingOrders(ctx context.Context, limit int) ([]string, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT number FROM orders WHERE status IN ('NEW', 'PROCESSING') ORDER BY uploaded_at LIMIT $1",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			return nil, err
+		}
+		orders = append(orders, number)
+	}
+	return orders, rows.Err()
+}
+
+func (s *DBStorage) SetOrderProcessing(ctx context.Context, orders []string) (map[string]int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx,
+		"UPDATE orders SET status = 'PROCESSING' WHERE number = $1 AND status = 'NEW' RETURNING user_id")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	userIDs := make(map[string]int)
+	for _, number := range orders {
+		var userID int
+		if err := stmt.QueryRowContext(ctx, number).Scan(&userID); err == nil {
+			userIDs[number] = userID
+		}
+	}
+
+	changed := make(map[int]bool)
+	for _, userID := range userIDs {
+		changed[userID] = true
+	}
+	if err := bumpDataVersions(ctx, tx, changed); err != nil {
+		return nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 	return userIDs, nil
-}
\ No newline at end of file
+}
+
+// bumpDataVersion marks the user's orders and balance as changed, which
+// invalidates the ETags handed out for them.
+const bumpDataVersion = "UPDATE users SET data_version = data_version + 1 WHERE id = $1"
+
+// bumpDataVersions bumps the versions of several users in ascending ID order,
+// so that concurrent transactions lock the rows in the same order instead of
+// deadlocking.
+func bumpDataVersions(ctx context.Context, tx *sql.Tx, userIDs map[int]bool) error {
+	for _, userID := range slices.Sorted(maps.Keys(userIDs)) {
+		if _, err := tx.ExecContext(ctx, bumpDataVersion, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bumpCounterparties bumps the data versions of the users the user has
+// transferred points to or received points from.
+func bumpCounterparties(ctx context.Context, tx *sql.Tx, userID int) error {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT recipient_id FROM transfers WHERE sender_id = $1
+		 UNION
+		 SELECT sender_id FROM transfers WHERE recipient_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	userIDs := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		userIDs[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	return bumpDataVersions(ctx, tx, userIDs)
+}
+
+func (s *DBStorage) GetDataVersion(ctx context.Context, userID int) (int64, error) {
+	var version int64
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT data_version FROM users WHERE id = $1",
+		userID,
+	).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return version, err
+}
+
+// EventsChannel is the Postgres notification channel announcing new user
+// events. The payload is the user ID.
+const EventsChannel = "user_events"
+
+// CreateEvent stores the event with the next number of the user's events and
+// notifies every replica listening on EventsChannel once the surrounding
+// transaction commits. The event ID is that number. Taking it locks the
+// user's sequence until the commit, so a reader never sees an event before
+// one with a lower ID that is still to come.
+func (s *DBStorage) CreateEvent(ctx context.Context, event *models.Event) error {
+	return s.DB.QueryRowContext(ctx,
+		`WITH seq AS (
+			INSERT INTO event_sequences (user_id, last_seq) VALUES ($1, 1)
+			ON CONFLICT (user_id) DO UPDATE SET last_seq = event_sequences.last_seq + 1
+			RETURNING last_seq
+		), e AS (
+			INSERT INTO user_events (user_id, seq, type, data, created_at)
+			SELECT $1, seq.last_seq, $2, $3, $4 FROM seq
+			RETURNING seq, user_id
+		)
+		SELECT e.seq FROM e, pg_notify($5, e.user_id::text)`,
+		event.UserID, event.Type, []byte(event.Data), event.CreatedAt, EventsChannel,
+	).Scan(&event.ID)
+}
+
+func (s *DBStorage) GetEvents(ctx context.Context, userID int, afterID int64, limit int) ([]models.Event, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT seq, type, data, created_at FROM user_events
+		 WHERE user_id = $1 AND seq > $2 ORDER BY seq LIMIT $3`,
+		userID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.Event
+	for rows.Next() {
+		event := models.Event{UserID: userID}
+		var data []byte
+		if err := rows.Scan(&event.ID, &event.Type, &data, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Data = data
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *DBStorage) GetLastEventID(ctx context.Context, userID int) (int64, error) {
+	var id int64
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT COALESCE((SELECT last_seq FROM event_sequences WHERE user_id = $1), 0)",
+		userID,
+	).Scan(&id)
+	return id, err
+}
+
+func (s *DBStorage) DeleteEventsBefore(ctx context.Context, before time.Time) error {
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM user_events WHERE created_at < $1", before)
+	return err
+}
+
+func (s *DBStorage) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	return s.DB.QueryRowContext(ctx,
+		`INSERT INTO webhooks (user_id, url, secret, events, created_at)
+		 VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		webhook.UserID, webhook.URL, webhook.Secret, strings.Join(webhook.Events, ","), webhook.CreatedAt,
+	).Scan(&webhook.ID)
+}
+
+// GetWebhooks returns the user's active webhooks without their secrets.
+func (s *DBStorage) GetWebhooks(ctx context.Context, userID int) ([]models.Webhook, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, url, events, created_at FROM webhooks
+		 WHERE user_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []models.Webhook
+	for rows.Next() {
+		webhook := models.Webhook{UserID: userID}
+		var events string
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &events, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook deactivates the webhook. Its delivery log is kept and pending
+// deliveries are dropped.
+func (s *DBStorage) DeleteWebhook(ctx context.Context, userID int, id int) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE webhooks SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL",
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE webhook_deliveries SET status = 'cancelled', next_attempt_at = NULL WHERE webhook_id = $1 AND status = 'pending'",
+		id,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateWebhookDeliveries queues the payload for every active webhook of the
+// user subscribed to the event.
+func (s *DBStorage) CreateWebhookDeliveries(ctx context.Context, userID int, event string, payload []byte) error {
+	_, err := s.DB.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		 SELECT id, $2, $3, 'pending', NOW(), NOW() FROM webhooks
+		 WHERE user_id = $1 AND deleted_at IS NULL AND $2 = ANY(string_to_array(events, ','))`,
+		userID, event, payload,
+	)
+	return err
+}
+
+// ClaimWebhookDeliveries returns due deliveries and postpones them by the
+// lease, so that other replicas skip them while they are being sent. A
+// delivery whose sender dies is retried once the lease expires. Deliveries
+// of deleted webhooks are never claimed.
+func (s *DBStorage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`UPDATE webhook_deliveries d SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+		 FROM webhooks w
+		 WHERE d.webhook_id = w.id AND w.deleted_at IS NULL AND d.id IN (
+			SELECT dd.id FROM webhook_deliveries dd
+			JOIN webhooks ww ON ww.id = dd.webhook_id AND ww.deleted_at IS NULL
+			WHERE dd.status = 'pending' AND dd.next_attempt_at <= NOW()
+			ORDER BY dd.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF dd SKIP LOCKED
+		 )
+		 RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, d.created_at, w.url, w.secret`,
+		limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		d := models.WebhookDelivery{Status: "pending"}
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt logs an attempt and moves the delivery to its new
+// status. nextAttemptAt is nil unless the delivery stays pending. A delivery
+// cancelled while it was being sent stays cancelled.
+func (s *DBStorage) RecordWebhookAttempt(ctx context.Context, deliveryID int64, attempt models.WebhookAttempt, status string, nextAttemptAt *time.Time) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx,
+		`INSERT INTO webhook_attempts (delivery_id, attempted_at, status_code, error, duration_ms)
+		 VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, ''), $5)`,
+		deliveryID, attempt.AttemptedAt, attempt.StatusCode, attempt.Error, attempt.DurationMS,
+	); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET
+			attempts = attempts + 1,
+			status = $2,
+			next_attempt_at = $3,
+			delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() END
+		 WHERE id = $1 AND status = 'pending'`,
+		deliveryID, status, nextAttemptAt,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetWebhookDeliveries returns the latest deliveries of a webhook, newest
+// first, each with its attempts.
+func (s *DBStorage) GetWebhookDeliveries(ctx context.Context, userID int, webhookID int, limit int) ([]models.WebhookDelivery, error) {
+	var owner int
+	err := s.DB.QueryRowContext(ctx, "SELECT user_id FROM webhooks WHERE id = $1", webhookID).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, created_at, delivered_at
+		 FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2`,
+		webhookID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	index := make(map[int64]int)
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var payload []byte
+		var nextAttemptAt, deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts,
+			&nextAttemptAt, &d.CreatedAt, &deliveredAt); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		if nextAttemptAt.Valid {
+			d.NextAttemptAt = &nextAttemptAt.Time
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		d.AttemptLog = []models.WebhookAttempt{}
+		index[d.ID] = len(deliveries)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return deliveries, nil
+	}
+
+	attempts, err := s.DB.QueryContext(ctx,
+		`SELECT a.delivery_id, a.attempted_at, COALESCE(a.status_code, 0), COALESCE(a.error, ''), a.duration_ms
+		 FROM webhook_attempts a
+		 WHERE a.delivery_id >= $1 AND a.delivery_id IN (SELECT id FROM webhook_deliveries WHERE webhook_id = $2)
+		 ORDER BY a.attempted_at`,
+		deliveries[len(deliveries)-1].ID, webhookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer attempts.Close()
+
+	for attempts.Next() {
+		var deliveryID int64
+		var a models.WebhookAttempt
+		if err := attempts.Scan(&deliveryID, &a.AttemptedAt, &a.StatusCode, &a.Error, &a.DurationMS); err != nil {
+			return nil, err
+		}
+		if i, ok := index[deliveryID]; ok {
+			deliveries[i].AttemptLog = append(deliveries[i].AttemptLog, a)
+		}
+	}
+	return deliveries, attempts.Err()
+}
+
+// TakeRateLimitToken takes a token from the bucket stored under key, creating
+// a full bucket on first use. Time is taken from the database so that
+// replicas with skewed clocks share buckets correctly.
+func (s *DBStorage) TakeRateLimitToken(ctx context.Context, key string, burst, perSecond float64) (float64, bool, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx,
+		"INSERT INTO rate_limits (key, tokens, updated_at) VALUES ($1, $2, NOW()) ON CONFLICT (key) DO NOTHING",
+		key, burst,
+	); err != nil {
+		return 0, false, err
+	}
+
+	var tokens, elapsed float64
+	if err = tx.QueryRowContext(ctx,
+		"SELECT tokens, EXTRACT(EPOCH FROM NOW() - updated_at) FROM rate_limits WHERE key = $1 FOR UPDATE",
+		key,
+	).Scan(&tokens, &elapsed); err != nil {
+		return 0, false, err
+	}
+
+	tokens, ok := utils.TakeToken(tokens, time.Duration(elapsed*float64(time.Second)), burst, perSecond)
+	if _, err = tx.ExecContext(ctx,
+		"UPDATE rate_limits SET tokens = $2, updated_at = NOW() WHERE key = $1",
+		key, tokens,
+	); err != nil {
+		return 0, false, err
+	}
+
+	return tokens, ok, tx.Commit()
+}
+
+func (s *DBStorage) DeleteRateLimitsBefore(ctx context.Context, before time.Time) error {
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated_at < $1", before)
+	return err
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+var amountPattern = regexp.MustCompile(`^[0-9]{1,12}(\.[0-9]{1,2})?$`)
+
+// FormatAmount writes a sum of points as a decimal string with two fractional
+// digits.
+func FormatAmount(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', 2, 64)
+}
+
+// ParseAmount parses a non-negative decimal string with at most two
+// fractional digits.
+func ParseAmount(s string) (float64, error) {
+	if !amountPattern.MatchString(s) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,54 @@
+package utils
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "100", want: 100},
+		{in: "0", want: 0},
+		{in: "12.5", want: 12.5},
+		{in: "0.01", want: 0.01},
+		{in: "999999999999.99", want: 999999999999.99},
+		{in: "1.005", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1e2", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "5.", wantErr: true},
+		{in: " 5", wantErr: true},
+		{in: "1000000000000", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseAmount(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseAmount(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string
+	}{
+		{in: 0, want: "0.00"},
+		{in: 100, want: "100.00"},
+		{in: 12.5, want: "12.50"},
+		{in: 0.1 + 0.2, want: "0.30"},
+		{in: 729.98, want: "729.98"},
+	}
+	for _, tt := range tests {
+		if got := FormatAmount(tt.in); got != tt.want {
+			t.Errorf("FormatAmount(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
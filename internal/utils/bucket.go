@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"math"
+	"time"
+)
+
+// TakeToken refills a token bucket holding tokens for the elapsed time and
+// takes one token if available. It returns the tokens left and whether one
+// was taken.
+func TakeToken(tokens float64, elapsed time.Duration, burst, perSecond float64) (float64, bool) {
+	if elapsed > 0 {
+		tokens = math.Min(burst, tokens+elapsed.Seconds()*perSecond)
+	}
+	if tokens < 1 {
+		return tokens, false
+	}
+	return tokens - 1, true
+}
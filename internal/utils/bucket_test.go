@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		wantTokens float64
+		wantTaken  bool
+	}{
+		{name: "full bucket", tokens: 5, wantTokens: 4, wantTaken: true},
+		{name: "last token", tokens: 1, wantTokens: 0, wantTaken: true},
+		{name: "empty bucket", tokens: 0.5, wantTokens: 0.5},
+		{name: "refilled", tokens: 0, elapsed: 2 * time.Second, wantTokens: 1, wantTaken: true},
+		{name: "partly refilled", tokens: 0, elapsed: 500 * time.Millisecond, wantTokens: 0.5},
+		{name: "refill capped at the burst", tokens: 4, elapsed: time.Hour, wantTokens: 4, wantTaken: true},
+		{name: "clock going back", tokens: 2, elapsed: -time.Minute, wantTokens: 1, wantTaken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, taken := TakeToken(tt.tokens, tt.elapsed, 5, 1)
+			if tokens != tt.wantTokens || taken != tt.wantTaken {
+				t.Fatalf("TakeToken() = %v, %v, want %v, %v", tokens, taken, tt.wantTokens, tt.wantTaken)
+			}
+		})
+	}
+}
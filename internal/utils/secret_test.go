@@ -0,0 +1,39 @@
+package utils
+
+import "testing"
+
+func TestSealSecret(t *testing.T) {
+	key := SecretKey("passphrase")
+	sealed, err := SealSecret(key, "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatalf("%q is not marked as sealed", sealed)
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "sealed", key: key, value: sealed, want: "JBSWY3DPEHPK3PXP"},
+		{name: "plain text from before encryption", key: key, value: "JBSWY3DPEHPK3PXP", want: "JBSWY3DPEHPK3PXP"},
+		{name: "wrong key", key: SecretKey("other"), value: sealed, wantErr: true},
+		{name: "truncated", key: key, value: sealed[:10], wantErr: true},
+		{name: "not base64", key: key, value: "enc:!!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OpenSecret(tt.key, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
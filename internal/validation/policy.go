@@ -0,0 +1,168 @@
+package validation
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gophermart/internal/problem"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+const maxPasswordLength = 256
+
+// FieldError describes a single violation of the input policy.
+type FieldError = problem.FieldError
+
+// Policy defines which logins and passwords are accepted at registration.
+type Policy struct {
+	loginPattern       *regexp.Regexp
+	passwordMinLength  int
+	passwordMinClasses int
+	blocklist          map[string]struct{}
+}
+
+// NewPolicy compiles the login pattern and loads the built-in list of common
+// passwords, extended by the optional blocklist file with one password per line.
+func NewPolicy(loginPattern string, passwordMinLength, passwordMinClasses int, blocklistFile string) (*Policy, error) {
+	re, err := regexp.Compile(loginPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid login pattern: %w", err)
+	}
+
+	p := &Policy{
+		loginPattern:       re,
+		passwordMinLength:  passwordMinLength,
+		passwordMinClasses: passwordMinClasses,
+		blocklist:          make(map[string]struct{}),
+	}
+
+	p.addBlocklist(bufio.NewScanner(strings.NewReader(commonPasswords)))
+	if blocklistFile != "" {
+		f, err := os.Open(blocklistFile)
+		if err != nil {
+			return nil, fmt.Errorf("open password blocklist: %w", err)
+		}
+		defer f.Close()
+		if err := p.addBlocklist(bufio.NewScanner(f)); err != nil {
+			return nil, fmt.Errorf("read password blocklist: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Policy) addBlocklist(scanner *bufio.Scanner) error {
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.blocklist[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// NormalizeLogin brings a login to Unicode NFKC form so that visually equal
+// logins are stored and looked up the same way. Case is folded by the database.
+func NormalizeLogin(login string) string {
+	return norm.NFKC.String(strings.TrimSpace(login))
+}
+
+// ValidateLogin checks an already normalized login.
+func (p *Policy) ValidateLogin(login string) []FieldError {
+	if login == "" {
+		return []FieldError{{Field: "login", Code: "required", Message: "Login is required"}}
+	}
+	if !utf8.ValidString(login) || strings.IndexFunc(login, unicode.IsControl) >= 0 {
+		return []FieldError{{Field: "login", Code: "invalid_characters", Message: "Login contains control characters"}}
+	}
+	if !p.loginPattern.MatchString(login) {
+		return []FieldError{{
+			Field:   "login",
+			Code:    "invalid_format",
+			Message: fmt.Sprintf("Login must match %s", p.loginPattern),
+		}}
+	}
+	return nil
+}
+
+// ValidatePassword checks password length, character variety and the list of
+// common or breached passwords.
+func (p *Policy) ValidatePassword(password, login string) []FieldError {
+	if password == "" {
+		return []FieldError{{Field: "password", Code: "required", Message: "Password is required"}}
+	}
+	if !utf8.ValidString(password) || strings.IndexFunc(password, unicode.IsControl) >= 0 {
+		return []FieldError{{Field: "password", Code: "invalid_characters", Message: "Password contains control characters"}}
+	}
+
+	var errs []FieldError
+	length := utf8.RuneCountInString(password)
+	if length < p.passwordMinLength {
+		errs = append(errs, FieldError{
+			Field:   "password",
+			Code:    "too_short",
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.passwordMinLength),
+		})
+	}
+	if length > maxPasswordLength {
+		errs = append(errs, FieldError{
+			Field:   "password",
+			Code:    "too_long",
+			Message: fmt.Sprintf("Password must be at most %d characters long", maxPasswordLength),
+		})
+	}
+	if characterClasses(password) < p.passwordMinClasses {
+		errs = append(errs, FieldError{
+			Field:   "password",
+			Code:    "too_weak",
+			Message: fmt.Sprintf("Password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.passwordMinClasses),
+		})
+	}
+	lower := strings.ToLower(password)
+	if _, ok := p.blocklist[lower]; ok {
+		errs = append(errs, FieldError{Field: "password", Code: "too_common", Message: "Password is too common"})
+	} else if login != "" && lower == strings.ToLower(login) {
+		errs = append(errs, FieldError{Field: "password", Code: "same_as_login", Message: "Password must differ from the login"})
+	}
+	return errs
+}
+
+// ValidateRegistration normalizes the login and checks both fields.
+func (p *Policy) ValidateRegistration(login, password string) (string, []FieldError) {
+	login = NormalizeLogin(login)
+	errs := p.ValidateLogin(login)
+	errs = append(errs, p.ValidatePassword(password, login)...)
+	return login, errs
+}
+
+func characterClasses(s string) int {
+	var lower, upper, digit, other bool
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package validation
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gophermart/internal/models"
+
+	"golang.org/x/text/language"
+)
+
+const maxDisplayNameLength = 100
+
+// phonePattern accepts numbers in E.164 format.
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizeProfile trims the profile fields and brings the email address and
+// locale to their canonical form where they can be parsed.
+func NormalizeProfile(p *models.Profile) {
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.Email = strings.TrimSpace(p.Email)
+	p.Phone = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '(' || r == ')' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(p.Phone))
+	if tag, err := language.Parse(strings.TrimSpace(p.Locale)); err == nil {
+		p.Locale = tag.String()
+	}
+}
+
+// ValidateProfile checks the editable profile fields. Email and phone may be
+// empty to clear them.
+func ValidateProfile(p *models.Profile) []FieldError {
+	var errs []FieldError
+
+	if !utf8.ValidString(p.DisplayName) || strings.IndexFunc(p.DisplayName, unicode.IsControl) >= 0 {
+		errs = append(errs, FieldError{Field: "display_name", Code: "invalid_characters", Message: "Display name contains control characters"})
+	} else if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		errs = append(errs, FieldError{Field: "display_name", Code: "too_long", Message: "Display name must be at most 100 characters long"})
+	}
+
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Address != p.Email || addr.Name != "" {
+			errs = append(errs, FieldError{Field: "email", Code: "invalid_format", Message: "Email must be a plain address like user@example.com"})
+		}
+	}
+
+	if p.Phone != "" && !phonePattern.MatchString(p.Phone) {
+		errs = append(errs, FieldError{Field: "phone", Code: "invalid_format", Message: "Phone must be in international format, e.g. +14155550123"})
+	}
+
+	if p.Locale == "" {
+		errs = append(errs, FieldError{Field: "locale", Code: "required", Message: "Locale is required"})
+	} else if _, err := language.Parse(p.Locale); err != nil {
+		errs = append(errs, FieldError{Field: "locale", Code: "invalid_format", Message: "Locale must be a BCP 47 language tag, e.g. en or ru-RU"})
+	}
+
+	return errs
+}